@@ -0,0 +1,153 @@
+package main
+
+import (
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Artifact is a file the coordinator registered for serving at /data/: a
+// source split, a side file, or one file of a committed task's output.
+// Partition is the reduce partition a map output file is for, and the
+// reduce task's own number for its output; it is -1 for anything else.
+type Artifact struct {
+    Job         string
+    Phase       string
+    Task        int
+    Partition   int
+    Name        string
+    Registered  time.Time
+    Purged      time.Time
+}
+
+// ArtifactServer serves only registered artifacts, through next. Anything
+// else, directories included, is not found, and an artifact that has been
+// purged is gone. Every request is logged.
+type ArtifactServer struct {
+    next    http.Handler
+    log     *Logger
+
+    mu      sync.Mutex
+    files   map[string]*Artifact
+}
+
+// NewArtifactServer serves registered artifacts through next, logging to
+// log, or the package logger when nil.
+func NewArtifactServer(next http.Handler, log *Logger) *ArtifactServer {
+    if log == nil {
+        log = logger
+    }
+    return &ArtifactServer{next: next, log: log, files: make(map[string]*Artifact)}
+}
+
+// Register makes a file servable, replacing what was registered under its
+// name before. A nil *ArtifactServer registers nothing.
+func (s *ArtifactServer) Register(a Artifact) {
+    if s == nil {
+        return
+    }
+    a.Registered = time.Now()
+    a.Purged = time.Time{}
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.files[a.Name] = &a
+}
+
+// Purge marks every artifact of job as gone, for once its files are
+// deleted.
+func (s *ArtifactServer) Purge(job string) {
+    if s == nil {
+        return
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    now := time.Now()
+    for _, a := range s.files {
+        if a.Job == job && a.Purged.IsZero() {
+            a.Purged = now
+        }
+    }
+}
+
+// PurgeTask marks the artifacts task n of phase committed as gone, for when
+// its output is deleted to be made again. Committing it again registers
+// it anew.
+func (s *ArtifactServer) PurgeTask(job, phase string, n int) {
+    if s == nil {
+        return
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    now := time.Now()
+    for _, a := range s.files {
+        if a.Job == job && a.Phase == phase && a.Task == n && a.Purged.IsZero() {
+            a.Purged = now
+        }
+    }
+}
+
+// lookup finds the artifact a request for name is for: the file itself,
+// or the copy of it stored compressed, which the data handler decodes.
+func (s *ArtifactServer) lookup(name string) (Artifact, bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if a, ok := s.files[name]; ok {
+        return *a, true
+    }
+    for _, codecName := range codecNames() {
+        codec, _ := CodecByName(codecName)
+        if a, ok := s.files[compressedName(name, codec)]; ok {
+            return *a, true
+        }
+    }
+    return Artifact{}, false
+}
+
+// statusWriter notes the status and size of a response, for the access log.
+type statusWriter struct {
+    http.ResponseWriter
+    status  int
+    bytes   int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+    if w.status == 0 {
+        w.status = status
+    }
+    w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+    if w.status == 0 {
+        w.status = http.StatusOK
+    }
+    n, err := w.ResponseWriter.Write(p)
+    w.bytes += int64(n)
+    return n, err
+}
+
+func (s *ArtifactServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    start := time.Now()
+    sw := &statusWriter{ResponseWriter: w}
+    name := strings.TrimPrefix(r.URL.Path, "/")
+    a, ok := s.lookup(name)
+    switch {
+    case !ok || strings.Contains(name, "/"):
+        http.Error(sw, "not found", http.StatusNotFound)
+    case !a.Purged.IsZero():
+        http.Error(sw, "purged", http.StatusGone)
+    case r.Method != http.MethodGet && r.Method != http.MethodHead:
+        http.Error(sw, "method not allowed", http.StatusMethodNotAllowed)
+    default:
+        s.next.ServeHTTP(sw, r)
+    }
+    kv := []interface{}{"file", name, "remote", r.RemoteAddr, "status", sw.status, "bytes", sw.bytes, "took", time.Since(start)}
+    if ok {
+        kv = append(kv, "job", a.Job, "phase", a.Phase, "task", a.Task, "partition", a.Partition)
+    }
+    if rng := r.Header.Get("Range"); rng != "" {
+        kv = append(kv, "range", rng)
+    }
+    s.log.Info("data access", kv...)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func newTestArtifactServer(t *testing.T) (*ArtifactServer, *httptest.Server) {
+    dir := t.TempDir()
+    for _, name := range []string{"job_map_0_output_0.db", "job_map_1_output_0.db", "job_reduce_0_output.db", "unregistered.db"} {
+        if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+        t.Fatal(err)
+    }
+    os.WriteFile(filepath.Join(dir, "sub", "job_map_0_output_0.db"), []byte("nested"), 0644)
+    s := NewArtifactServer(dataHandler(dir), NewLogger(io.Discard, LevelError, false))
+    s.Register(Artifact{Job: "job", Phase: "map", Task: 0, Partition: 0, Name: "job_map_0_output_0.db"})
+    s.Register(Artifact{Job: "job", Phase: "map", Task: 1, Partition: 0, Name: "job_map_1_output_0.db"})
+    s.Register(Artifact{Job: "job", Phase: "reduce", Task: 0, Partition: 0, Name: "job_reduce_0_output.db"})
+    srv := httptest.NewServer(s)
+    t.Cleanup(srv.Close)
+    return s, srv
+}
+
+func getStatus(t *testing.T, method, url string) int {
+    t.Helper()
+    req, err := http.NewRequest(method, url, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+    return resp.StatusCode
+}
+
+func TestArtifactServerServesOnlyRegistered(t *testing.T) {
+    _, srv := newTestArtifactServer(t)
+    for path, want := range map[string]int{
+        "/job_map_0_output_0.db":                   http.StatusOK,
+        "/job_reduce_0_output.db":                  http.StatusOK,
+        "/unregistered.db":                         http.StatusNotFound,
+        "/missing.db":                              http.StatusNotFound,
+        "/":                                        http.StatusNotFound,
+        "/sub":                                     http.StatusNotFound,
+        "/sub/job_map_0_output_0.db":               http.StatusNotFound,
+        "/sub/../job_map_0_output_0.db":            http.StatusNotFound,
+        "/..%2fjob_map_0_output_0.db":              http.StatusNotFound,
+        "/%2e%2e/%2e%2e/etc/passwd":                http.StatusNotFound,
+        "/sub%2fjob_map_0_output_0.db":             http.StatusNotFound,
+    } {
+        if got := getStatus(t, "GET", srv.URL+path); got != want {
+            t.Errorf("GET %s: status %d, want %d", path, got, want)
+        }
+    }
+    if got := getStatus(t, "HEAD", srv.URL+"/job_map_0_output_0.db"); got != http.StatusOK {
+        t.Errorf("HEAD: status %d, want %d", got, http.StatusOK)
+    }
+    if got := getStatus(t, "DELETE", srv.URL+"/job_map_0_output_0.db"); got != http.StatusMethodNotAllowed {
+        t.Errorf("DELETE: status %d, want %d", got, http.StatusMethodNotAllowed)
+    }
+}
+
+func TestArtifactServerPurge(t *testing.T) {
+    s, srv := newTestArtifactServer(t)
+    s.PurgeTask("job", "map", 0)
+    for path, want := range map[string]int{
+        "/job_map_0_output_0.db":   http.StatusGone,
+        "/job_map_1_output_0.db":   http.StatusOK,
+        "/job_reduce_0_output.db":  http.StatusOK,
+    } {
+        if got := getStatus(t, "GET", srv.URL+path); got != want {
+            t.Errorf("after PurgeTask, GET %s: status %d, want %d", path, got, want)
+        }
+    }
+
+    // A task committed again is served again.
+    s.Register(Artifact{Job: "job", Phase: "map", Task: 0, Partition: 0, Name: "job_map_0_output_0.db"})
+    if got := getStatus(t, "GET", srv.URL+"/job_map_0_output_0.db"); got != http.StatusOK {
+        t.Errorf("after registering again: status %d, want %d", got, http.StatusOK)
+    }
+
+    s.Register(Artifact{Job: "other", Phase: "map", Task: 0, Partition: 0, Name: "unregistered.db"})
+    s.Purge("job")
+    for path, want := range map[string]int{
+        "/job_map_0_output_0.db":   http.StatusGone,
+        "/job_map_1_output_0.db":   http.StatusGone,
+        "/job_reduce_0_output.db":  http.StatusGone,
+        "/unregistered.db":         http.StatusOK,
+    } {
+        if got := getStatus(t, "GET", srv.URL+path); got != want {
+            t.Errorf("after Purge, GET %s: status %d, want %d", path, got, want)
+        }
+    }
+}
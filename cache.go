@@ -0,0 +1,181 @@
+package main
+
+import (
+    "bufio"
+    "database/sql"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+)
+
+func cacheFile(job, name string) string {return fmt.Sprintf("%s_cache_%s", job, name)}
+
+// Cache holds the read-only side files of a job once a worker has fetched
+// them. Files are downloaded once per job and shared by every task the
+// worker runs for it.
+type Cache struct {
+    dir     string
+    files   map[string]string
+
+    mu      sync.Mutex
+    tables  map[string]map[string]string
+}
+
+var caches = struct {
+    sync.Mutex
+    m   map[string]*Cache
+}{m: make(map[string]*Cache)}
+
+// publishCacheFiles copies the coordinator's side files into the job's
+// store so tasks can fetch them. It returns the names tasks should ask for
+// and the checksums of the published files, by their name in store.
+func publishCacheFiles(job string, paths []string, store Storage) ([]string, map[string]string, error) {
+    var names []string
+    checksums := make(map[string]string)
+    for _, path := range paths {
+        name := filepath.Base(path)
+        sum, err := fileChecksum(path)
+        if err != nil {
+            return names, checksums, fmt.Errorf("publishing cache file %s: %v", path, err)
+        }
+        if err := copyFile(path, store, cacheFile(job, name)); err != nil {
+            return names, checksums, fmt.Errorf("publishing cache file %s: %v", path, err)
+        }
+        names = append(names, name)
+        checksums[cacheFile(job, name)] = sum
+    }
+    return names, checksums, nil
+}
+
+// copyFile copies the local file at src into store as name.
+func copyFile(src string, store Storage, name string) error {
+    in, err := os.Open(src)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+    out, err := store.Create(name)
+    if err != nil {
+        return err
+    }
+    if _, err := io.Copy(out, in); err != nil {
+        out.Close()
+        return err
+    }
+    return out.Close()
+}
+
+// loadCache returns the worker's copy of the job's cache, fetching the
+// named files from store the first time any task of the job asks for it.
+// Files with a checksum in checksums, by their name in store, are fetched
+// again until they match it.
+func loadCache(store Storage, job string, names []string, checksums map[string]string, tempdir string) (*Cache, error) {
+    key := store.URL(job)
+    caches.Lock()
+    defer caches.Unlock()
+    if c, ok := caches.m[key]; ok {
+        return c, nil
+    }
+    c := &Cache{
+        dir:    filepath.Join(tempdir, job+"_cache"),
+        files:  make(map[string]string),
+        tables: make(map[string]map[string]string),
+    }
+    if err := os.MkdirAll(c.dir, 0755); err != nil {
+        return nil, err
+    }
+    for _, name := range names {
+        path, err := fetchVerified(store, cacheFile(job, name), filepath.Join(c.dir, name), checksums[cacheFile(job, name)])
+        if err != nil {
+            return nil, fmt.Errorf("fetching cache file %s: %w", name, err)
+        }
+        c.files[name] = path
+    }
+    caches.m[key] = c
+    return c, nil
+}
+
+// Path returns the local path of a cache file.
+func (c *Cache) Path(name string) (string, bool) {
+    if c == nil {
+        return "", false
+    }
+    path, ok := c.files[name]
+    return path, ok
+}
+
+// Open opens a SQLite cache file. The caller closes it.
+func (c *Cache) Open(name string) (*sql.DB, error) {
+    path, ok := c.Path(name)
+    if !ok {
+        return nil, fmt.Errorf("no cache file named %s", name)
+    }
+    return openDatabase(path)
+}
+
+// Lookup finds key in a cache file used as a lookup table. SQLite files are
+// read from their pairs table; anything else is read as text with one
+// tab-separated key and value per line. The table is loaded into memory on
+// first use.
+func (c *Cache) Lookup(name, key string) (string, bool, error) {
+    path, ok := c.Path(name)
+    if !ok {
+        return "", false, fmt.Errorf("no cache file named %s", name)
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    table, ok := c.tables[name]
+    if !ok {
+        var err error
+        if table, err = loadTable(path); err != nil {
+            return "", false, fmt.Errorf("loading cache file %s: %v", name, err)
+        }
+        c.tables[name] = table
+    }
+    value, ok := table[key]
+    return value, ok, nil
+}
+
+func loadTable(path string) (map[string]string, error) {
+    table := make(map[string]string)
+    switch filepath.Ext(path) {
+    case ".db", ".sqlite", ".sqlite3":
+        db, err := openDatabase(path)
+        if err != nil {
+            return nil, err
+        }
+        defer db.Close()
+        rows, err := db.Query("SELECT key, value FROM pairs")
+        if err != nil {
+            return nil, err
+        }
+        defer rows.Close()
+        for rows.Next() {
+            var k, v string
+            if err := rows.Scan(&k, &v); err != nil {
+                return nil, err
+            }
+            table[k] = v
+        }
+        return table, rows.Err()
+    }
+
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        line := scanner.Text()
+        if i := strings.IndexByte(line, '\t'); i >= 0 {
+            table[line[:i]] = line[i+1:]
+        } else if line != "" {
+            table[line] = ""
+        }
+    }
+    return table, scanner.Err()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+    "errors"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestLoadCacheVerifiesChecksums(t *testing.T) {
+    dir := t.TempDir()
+    side := filepath.Join(dir, "side.txt")
+    if err := os.WriteFile(side, []byte("a\t1\nb\t2\n"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    store := &LocalStorage{Dir: filepath.Join(dir, "store")}
+    names, checksums, err := publishCacheFiles("job", []string{side}, store)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(names) != 1 || names[0] != "side.txt" || checksums[cacheFile("job", "side.txt")] == "" {
+        t.Fatalf("published %v with checksums %v", names, checksums)
+    }
+
+    cache, err := loadCache(store, "job", names, checksums, filepath.Join(dir, "good"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if value, ok, err := cache.Lookup("side.txt", "b"); err != nil || !ok || value != "2" {
+        t.Errorf("Lookup(b) = %q, %v, %v, want 2", value, ok, err)
+    }
+
+    // A copy changed after it was published is refused.
+    other := &LocalStorage{Dir: store.Dir, Host: "other"}
+    if err := os.WriteFile(other.Path(cacheFile("job", "side.txt")), []byte("a\t9\n"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    var corrupt *ChecksumError
+    if _, err := loadCache(other, "job", names, checksums, filepath.Join(dir, "bad")); !errors.As(err, &corrupt) {
+        t.Errorf("loading a changed cache file: %v, want a checksum error", err)
+    }
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+)
+
+// fetchRetries is how many more times a file that fails its checksum is
+// fetched before the copy in the store is taken to be corrupt.
+const fetchRetries = 2
+
+// fileChecksum is the checksum recorded for a file when it is committed and
+// compared with every copy fetched later.
+func fileChecksum(path string) (string, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return "", err
+    }
+    defer f.Close()
+    h := sha256.New()
+    if _, err := io.Copy(h, f); err != nil {
+        return "", err
+    }
+    return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fileChecksums returns the checksum of each file, by file name, in dir.
+func fileChecksums(dir string, files []string) (map[string]string, error) {
+    sums := make(map[string]string)
+    for _, file := range files {
+        sum, err := fileChecksum(filepath.Join(dir, file))
+        if err != nil {
+            return sums, err
+        }
+        sums[file] = sum
+    }
+    return sums, nil
+}
+
+// ChecksumError is a fetched file that does not match the checksum it was
+// committed with.
+type ChecksumError struct {
+    Name        string
+    Want, Got   string
+}
+
+func (e *ChecksumError) Error() string {
+    return fmt.Sprintf("%s: checksum %s, want %s", e.Name, e.Got, e.Want)
+}
+
+// MapOutputError is a map task's output a reduce task could not get a good
+// copy of. The coordinator runs the map task again.
+type MapOutputError struct {
+    Map     int
+    Err     error
+}
+
+func (e *MapOutputError) Error() string {return fmt.Sprintf("output of map %d: %v", e.Map, e.Err)}
+
+func (e *MapOutputError) Unwrap() error {return e.Err}
+
+// fetchVerified fetches name like fetch and checks it against want, which
+// may be empty when no checksum was recorded. A copy that does not match is
+// fetched again, up to fetchRetries times.
+func fetchVerified(store Storage, name, path, want string) (string, error) {
+    for try := 0; ; try++ {
+        local, err := fetch(store, name, path)
+        if err != nil || want == "" {
+            return local, err
+        }
+        got, err := fileChecksum(local)
+        if err != nil {
+            return local, err
+        }
+        if got == want {
+            return local, nil
+        }
+        err = &ChecksumError{Name: redactURL(store.URL(name)), Want: want, Got: got}
+        // A local store hands out the stored file itself, which another
+        // fetch would not change.
+        if try == fetchRetries || local != path {
+            return local, err
+        }
+        logger.Warn("fetched a corrupt copy, fetching it again", "err", err)
+        os.Remove(local)
+    }
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+)
+
+// attemptID names one attempt of one task of a job, e.g.
+// job_20210401_120000_42_map_3_attempt_2.
+func attemptID(job, phase string, n, attempt int) string {return fmt.Sprintf("%s_%s_%d_attempt_%d", job, phase, n, attempt)}
+
+// OutputCommitter keeps task attempts from ever exposing partial output.
+// Every attempt writes into a directory of its own under Dir/_temporary,
+// and only the attempt that wins has its files published to Store, which
+// is Dir itself when nil. Into a local store that is a rename, which is
+// atomic, so a file under its final name is always a complete one, and
+// whatever a crashed attempt leaves behind stays under _temporary where
+// nothing reads it.
+type OutputCommitter struct {
+    Dir     string
+    JobID   string
+    Store   Storage
+}
+
+func (c *OutputCommitter) store() Storage {
+    if c.Store != nil {
+        return c.Store
+    }
+    return &LocalStorage{Dir: c.Dir}
+}
+
+func (c *OutputCommitter) temporary() string {return filepath.Join(c.Dir, "_temporary")}
+
+// SetupJob clears out attempts of the job left over from an earlier run,
+// leaving those of other jobs alone.
+func (c *OutputCommitter) SetupJob() error {
+    if err := os.MkdirAll(c.temporary(), 0755); err != nil {
+        return err
+    }
+    stale, err := filepath.Glob(filepath.Join(c.temporary(), c.JobID+"_*"))
+    if err != nil {
+        return err
+    }
+    for _, dir := range stale {
+        if err := os.RemoveAll(dir); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (c *OutputCommitter) AttemptDir(phase string, n, attempt int) string {
+    return filepath.Join(c.temporary(), attemptID(c.JobID, phase, n, attempt))
+}
+
+// SetupAttempt gives an attempt an empty directory to write into.
+func (c *OutputCommitter) SetupAttempt(phase string, n, attempt int) (string, error) {
+    dir := c.AttemptDir(phase, n, attempt)
+    if err := os.RemoveAll(dir); err != nil {
+        return dir, err
+    }
+    return dir, os.MkdirAll(dir, 0755)
+}
+
+// CommitAttempt publishes files from the attempt's directory and then
+// removes whatever else the attempt wrote. It returns the checksums of the
+// files as published, for readers to check their copies against.
+func (c *OutputCommitter) CommitAttempt(phase string, n, attempt int, files []string) (map[string]string, error) {
+    dir := c.AttemptDir(phase, n, attempt)
+    checksums, err := fileChecksums(dir, files)
+    if err != nil {
+        return nil, fmt.Errorf("committing %s: %v", attemptID(c.JobID, phase, n, attempt), err)
+    }
+    for _, file := range files {
+        if err := publish(c.store(), filepath.Join(dir, file), file); err != nil {
+            return nil, fmt.Errorf("committing %s: %v", attemptID(c.JobID, phase, n, attempt), err)
+        }
+    }
+    return checksums, os.RemoveAll(dir)
+}
+
+// AbortAttempt throws away everything an attempt wrote.
+func (c *OutputCommitter) AbortAttempt(phase string, n, attempt int) error {
+    return os.RemoveAll(c.AttemptDir(phase, n, attempt))
+}
+
+// removeJobFiles deletes everything a job left in a store and a data
+// directory shared with other jobs: its splits, intermediate and output
+// files, its side files and any attempts still under _temporary.
+func removeJobFiles(store Storage, dir, job string) {
+    if names, err := store.List(job + "_"); err == nil {
+        for _, name := range names {
+            store.Remove(name)
+        }
+    }
+    for _, pattern := range []string{
+        filepath.Join(dir, job+"_*"),
+        filepath.Join(dir, "_temporary", job+"_*"),
+    } {
+        matches, _ := filepath.Glob(pattern)
+        for _, path := range matches {
+            os.RemoveAll(path)
+        }
+    }
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+    "compress/gzip"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// Codec compresses intermediate files at rest and in transit. Its Name is
+// also the HTTP content-coding it is negotiated under on /data/, and a file
+// stored compressed with it has Extension appended to its name.
+type Codec interface {
+    Name() string
+    Extension() string
+    NewWriter(w io.Writer) (io.WriteCloser, error)
+    NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = struct {
+    sync.Mutex
+    m   map[string]Codec
+}{m: map[string]Codec{"gzip": GzipCodec{Level: gzip.DefaultCompression}}}
+
+// RegisterCodec makes a codec available to -compress and to content
+// negotiation, replacing any codec of the same name.
+func RegisterCodec(c Codec) {
+    codecs.Lock()
+    defer codecs.Unlock()
+    codecs.m[c.Name()] = c
+}
+
+// CodecByName returns the named codec, or nil for "" and "none".
+func CodecByName(name string) (Codec, error) {
+    if name == "" || name == "none" {
+        return nil, nil
+    }
+    codecs.Lock()
+    defer codecs.Unlock()
+    if c, ok := codecs.m[name]; ok {
+        return c, nil
+    }
+    return nil, fmt.Errorf("unknown codec %q", name)
+}
+
+// codecNames lists the registered codecs, for Accept-Encoding.
+func codecNames() []string {
+    codecs.Lock()
+    defer codecs.Unlock()
+    var names []string
+    for name := range codecs.m {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// GzipCodec is gzip at Level, which ranges from gzip.HuffmanOnly to
+// gzip.BestCompression.
+type GzipCodec struct {
+    Level   int
+}
+
+func (GzipCodec) Name() string {return "gzip"}
+
+func (GzipCodec) Extension() string {return ".gz"}
+
+func (c GzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {return gzip.NewWriterLevel(w, c.Level)}
+
+func (GzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {return gzip.NewReader(r)}
+
+// compressedName is what the file name is stored as under codec.
+func compressedName(name string, codec Codec) string {
+    if codec == nil {
+        return name
+    }
+    return name + codec.Extension()
+}
+
+// compressedNames applies compressedName to every name.
+func compressedNames(names []string, codec Codec) []string {
+    out := make([]string, len(names))
+    for i, name := range names {
+        out[i] = compressedName(name, codec)
+    }
+    return out
+}
+
+// compressFile replaces the local file at path with its compressed copy
+// under the compressed name, and returns the new path.
+func compressFile(path string, codec Codec) (string, error) {
+    if codec == nil {
+        return path, nil
+    }
+    compressed := compressedName(path, codec)
+    if err := transcode(path, compressed, codec.NewWriter, nil); err != nil {
+        return compressed, fmt.Errorf("compressing %s: %v", path, err)
+    }
+    return compressed, os.Remove(path)
+}
+
+// decompressFile writes what the compressed local file at from holds to
+// to. The compressed file is left alone: in a local store it is the
+// committed copy itself.
+func decompressFile(from, to string, codec Codec) error {
+    if err := transcode(from, to, nil, codec.NewReader); err != nil {
+        return fmt.Errorf("decompressing %s: %v", from, err)
+    }
+    return nil
+}
+
+func transcode(from, to string, writer func(io.Writer) (io.WriteCloser, error), reader func(io.Reader) (io.ReadCloser, error)) error {
+    in, err := os.Open(from)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+    var r io.Reader = in
+    if reader != nil {
+        rc, err := reader(in)
+        if err != nil {
+            return err
+        }
+        defer rc.Close()
+        r = rc
+    }
+    out, err := os.Create(to)
+    if err != nil {
+        return err
+    }
+    var w io.WriteCloser = out
+    if writer != nil {
+        if w, err = writer(out); err != nil {
+            out.Close()
+            return err
+        }
+    }
+    if _, err := io.Copy(w, r); err != nil {
+        w.Close()
+        out.Close()
+        return err
+    }
+    if w != out {
+        if err := w.Close(); err != nil {
+            out.Close()
+            return err
+        }
+    }
+    return out.Close()
+}
+
+// fetchCompressed fetches the named files, stored compressed with codec,
+// and decompresses each into dir under its plain name. It returns the
+// local paths and how many bytes were fetched. Checksums are of the stored,
+// compressed files.
+func fetchCompressed(store Storage, names []string, codec Codec, dir string, checksums map[string]string) ([]string, int64, error) {
+    fetched, err := fetchAll(store, compressedNames(names, codec), dir, checksums)
+    var size int64
+    for _, path := range fetched {
+        if info, err := os.Stat(path); err == nil {
+            size += info.Size()
+        }
+    }
+    if err != nil || codec == nil {
+        return fetched, size, err
+    }
+    var paths []string
+    for i, path := range fetched {
+        plain := filepath.Join(dir, filepath.Base(names[i]))
+        if err := decompressFile(path, plain, codec); err != nil {
+            return paths, size, err
+        }
+        paths = append(paths, plain)
+    }
+    return paths, size, nil
+}
+
+// acceptedCodec picks the first registered codec an Accept-Encoding header
+// allows, or nil when it allows none of them.
+func acceptedCodec(header string) Codec {
+    codecs.Lock()
+    defer codecs.Unlock()
+    for _, part := range strings.Split(header, ",") {
+        coding := strings.TrimSpace(part)
+        q := ""
+        if i := strings.IndexByte(coding, ';'); i >= 0 {
+            coding, q = strings.TrimSpace(coding[:i]), strings.TrimSpace(coding[i+1:])
+        }
+        if q == "q=0" || q == "q=0.0" {
+            continue
+        }
+        if c, ok := codecs.m[coding]; ok {
+            return c
+        }
+    }
+    return nil
+}
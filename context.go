@@ -0,0 +1,73 @@
+package main
+
+import "fmt"
+
+// TaskContext is what a running task exposes to user code beyond the
+// key/value stream: which task it is, the job's side data, the task's
+// counters and a logger already carrying the job and task fields.
+type TaskContext struct {
+    Phase       string
+    N           int
+    Cache       *Cache
+    Counters    *Counters
+    Log         *Logger
+}
+
+// ContextMapper is implemented by mappers that want the TaskContext. When a
+// mapper implements it, MapContext is called instead of Map.
+type ContextMapper interface {
+    MapContext(ctx *TaskContext, key, value string, output chan<- Pair) error
+}
+
+// ContextReducer is the reduce side counterpart of ContextMapper.
+type ContextReducer interface {
+    ReduceContext(ctx *TaskContext, key string, values <-chan string, output chan<- Pair) error
+}
+
+// UserError is a failure of user code on one input record, or on one key
+// group on the reduce side, whether it returned an error or panicked.
+type UserError struct {
+    Phase   string
+    Record  int64
+    Key     string
+    Err     error
+}
+
+func (e *UserError) Error() string {
+    if e.Phase == "reduce" {
+        return fmt.Sprintf("reduce of key %q: %v", e.Key, e.Err)
+    }
+    return fmt.Sprintf("map of record %d (key %q): %v", e.Record, e.Key, e.Err)
+}
+
+func (e *UserError) Unwrap() error {return e.Err}
+
+// recoverUser turns a panic in user code into an error. Deferred by the
+// functions that call into user code.
+func recoverUser(err *error) {
+    if r := recover(); r != nil {
+        *err = fmt.Errorf("panic: %v", r)
+    }
+}
+
+// closeQuietly closes a channel user code may already have closed.
+func closeQuietly(ch chan Pair) {
+    defer func() { recover() }()
+    close(ch)
+}
+
+func runMap(ctx *TaskContext, mapper Mapper, key, value string, output chan<- Pair) (err error) {
+    defer recoverUser(&err)
+    if m, ok := mapper.(ContextMapper); ok {
+        return m.MapContext(ctx, key, value, output)
+    }
+    return mapper.Map(key, value, output)
+}
+
+func runReduce(ctx *TaskContext, client Interface, key string, values <-chan string, output chan<- Pair) (err error) {
+    defer recoverUser(&err)
+    if r, ok := client.(ContextReducer); ok {
+        return r.ReduceContext(ctx, key, values, output)
+    }
+    return client.Reduce(key, values, output)
+}
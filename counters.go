@@ -0,0 +1,114 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// Counters maintained by the runtime for every task, next to whatever user
+// code increments through its TaskContext.
+const (
+    CounterMapInputBytes       = "map_input_bytes"
+    CounterMapInputRecords     = "map_input_records"
+    CounterMapOutputRecords    = "map_output_records"
+    CounterReduceInputRecords  = "reduce_input_records"
+    CounterReduceInputGroups   = "reduce_input_groups"
+    CounterReduceOutputRecords = "reduce_output_records"
+    CounterShuffleBytes        = "shuffle_bytes"
+    CounterMapSkippedRecords    = "map_skipped_records"
+    CounterReduceSkippedGroups  = "reduce_skipped_groups"
+    CounterReduceSkippedRecords = "reduce_skipped_records"
+)
+
+// Counters is a set of named totals. It is safe for concurrent use, and a
+// nil *Counters ignores increments so code can count unconditionally.
+type Counters struct {
+    mu      sync.Mutex
+    values  map[string]int64
+}
+
+func NewCounters() *Counters {
+    return &Counters{values: make(map[string]int64)}
+}
+
+func (c *Counters) Increment(name string, delta int64) {
+    if c == nil {
+        return
+    }
+    c.mu.Lock()
+    c.values[name] += delta
+    c.mu.Unlock()
+}
+
+func (c *Counters) Get(name string) int64 {
+    if c == nil {
+        return 0
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.values[name]
+}
+
+// Snapshot returns a copy of the current totals.
+func (c *Counters) Snapshot() map[string]int64 {
+    values := make(map[string]int64)
+    if c == nil {
+        return values
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    for name, v := range c.values {
+        values[name] = v
+    }
+    return values
+}
+
+// Merge adds every total in other to c.
+func (c *Counters) Merge(other *Counters) {
+    for name, v := range other.Snapshot() {
+        c.Increment(name, v)
+    }
+}
+
+func (c *Counters) Names() []string {
+    var names []string
+    for name := range c.Snapshot() {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+func (c *Counters) String() string {
+    var b strings.Builder
+    values := c.Snapshot()
+    for _, name := range c.Names() {
+        fmt.Fprintf(&b, "%s=%d\n", name, values[name])
+    }
+    return b.String()
+}
+
+// countersFile is where the job's counters are kept next to its output,
+// e.g. result_counters.db for result.db.
+func countersFile(output string) string {
+    return strings.TrimSuffix(output, ".db") + "_counters.db"
+}
+
+// Save writes the totals into a new database at path, one pair per counter.
+func (c *Counters) Save(path string) error {
+    db, err := createDatabase(path)
+    if err != nil {
+        return err
+    }
+    defer db.Close()
+    values := c.Snapshot()
+    for _, name := range c.Names() {
+        if _, err := db.Exec("INSERT INTO pairs(key, value) values(?, ?)", name, strconv.FormatInt(values[name], 10)); err != nil {
+            return fmt.Errorf("saving counter %s: %v", name, err)
+        }
+    }
+    return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+    "io"
+    "net/http"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+)
+
+// dataHandler serves the files in dir, negotiating a content-coding with
+// the client. A client that accepts one of the registered codecs gets a
+// file compressed with it: as stored when there is a compressed copy, and
+// compressed on the fly when there is only the plain file. A client that
+// accepts none gets a file kept only in compressed form decompressed.
+// Range requests and files that are themselves compressed are served as
+// they are.
+func dataHandler(dir string) http.Handler {
+    files := http.FileServer(http.Dir(dir))
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Add("Vary", "Accept-Encoding")
+        name := path.Clean("/" + r.URL.Path)
+        local := filepath.Join(dir, filepath.FromSlash(name))
+        accepted := acceptedCodec(r.Header.Get("Accept-Encoding"))
+        if info, err := os.Stat(local); err == nil {
+            if info.IsDir() || accepted == nil || r.Header.Get("Range") != "" || compressedCodec(name) != nil {
+                files.ServeHTTP(w, r)
+                return
+            }
+            serveEncoded(w, r, local, nil, accepted)
+            return
+        }
+        for _, codecName := range codecNames() {
+            codec, _ := CodecByName(codecName)
+            stored := compressedName(local, codec)
+            if _, err := os.Stat(stored); err != nil {
+                continue
+            }
+            if accepted != nil && accepted.Name() == codec.Name() {
+                w.Header().Set("Content-Encoding", codec.Name())
+                serveEncoded(w, r, stored, nil, nil)
+            } else {
+                serveEncoded(w, r, stored, codec, accepted)
+            }
+            return
+        }
+        files.ServeHTTP(w, r)
+    })
+}
+
+// serveEncoded writes the file at path, decoded with from and encoded with
+// to when they are set, and labels the response with to.
+func serveEncoded(w http.ResponseWriter, r *http.Request, path string, from, to Codec) {
+    f, err := os.Open(path)
+    if err != nil {
+        http.Error(w, "not found", http.StatusNotFound)
+        return
+    }
+    defer f.Close()
+    var in io.Reader = f
+    if from != nil {
+        decoded, err := from.NewReader(f)
+        if err != nil {
+            http.Error(w, "corrupt file", http.StatusInternalServerError)
+            return
+        }
+        defer decoded.Close()
+        in = decoded
+    }
+    w.Header().Set("Content-Type", "application/octet-stream")
+    if to == nil {
+        if from == nil {
+            if info, err := f.Stat(); err == nil {
+                http.ServeContent(w, r, "", info.ModTime(), f)
+                return
+            }
+        }
+        if r.Method != http.MethodHead {
+            io.Copy(w, in)
+        }
+        return
+    }
+    w.Header().Set("Content-Encoding", to.Name())
+    if r.Method == http.MethodHead {
+        return
+    }
+    out, err := to.NewWriter(w)
+    if err != nil {
+        return
+    }
+    io.Copy(out, in)
+    out.Close()
+}
+
+// compressedCodec returns the registered codec whose extension name ends
+// in, if any.
+func compressedCodec(name string) Codec {
+    for _, codecName := range codecNames() {
+        if codec, _ := CodecByName(codecName); strings.HasSuffix(name, codec.Extension()) {
+            return codec
+        }
+    }
+    return nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// MaxFetchesPerHost caps how many files are fetched from any one host at
+// once, across every task running in the process.
+var MaxFetchesPerHost = 4
+
+var fetchSlots = struct {
+    sync.Mutex
+    m   map[string]chan struct{}
+}{m: make(map[string]chan struct{})}
+
+// acquireFetch waits for a free fetch slot on host and returns the function
+// that frees it.
+func acquireFetch(host string) func() {
+    fetchSlots.Lock()
+    slots, ok := fetchSlots.m[host]
+    if !ok {
+        n := MaxFetchesPerHost
+        if n < 1 {
+            n = 1
+        }
+        slots = make(chan struct{}, n)
+        fetchSlots.m[host] = slots
+    }
+    fetchSlots.Unlock()
+    slots <- struct{}{}
+    var once sync.Once
+    return func() { once.Do(func() { <-slots }) }
+}
+
+func (s *HTTPStorage) retries() int {
+    if s.Retries > 0 {
+        return s.Retries
+    }
+    return 4
+}
+
+func (s *HTTPStorage) backoff(try int) time.Duration {
+    d := s.Backoff
+    if d <= 0 {
+        d = 500 * time.Millisecond
+    }
+    for i := 1; i < try && d < 30*time.Second; i++ {
+        d *= 2
+    }
+    return d
+}
+
+// permanentError is a failed request that retrying would not help, such as
+// one for a file the server does not have.
+type permanentError struct {
+    err     error
+}
+
+func (e permanentError) Error() string {return e.err.Error()}
+
+func (e permanentError) Unwrap() error {return e.err}
+
+// Open fetches the file, holding one of the host's fetch slots until it is
+// closed. The file is asked for in any registered codec so the transfer is
+// compressed whenever the server can do it, and what comes back is
+// decoded. A transfer that breaks off is picked up where it stopped: with
+// a Range request when the server sent the file as stored and supports
+// them, and otherwise by fetching it again and skipping what was read.
+func (s *HTTPStorage) Open(name string) (io.ReadCloser, error) {
+    release := acquireFetch(s.Host)
+    b := &resumableBody{s: s, name: name, release: release}
+    if err := b.retry(nil); err != nil {
+        release()
+        return nil, err
+    }
+    return b, nil
+}
+
+// resumableBody is the decoded content of a file being fetched, which
+// reopens the transfer after an error part way.
+type resumableBody struct {
+    s       *HTTPStorage
+    name    string
+    body    io.ReadCloser
+    read    int64
+    ranges  bool
+    tries   int
+    err     error
+    release func()
+}
+
+func (b *resumableBody) Read(p []byte) (int, error) {
+    if b.err != nil {
+        return 0, b.err
+    }
+    for {
+        n, err := b.body.Read(p)
+        b.read += int64(n)
+        if err == nil || err == io.EOF {
+            return n, err
+        }
+        b.err = b.retry(err)
+        if n > 0 {
+            return n, nil
+        }
+        if b.err != nil {
+            return 0, b.err
+        }
+    }
+}
+
+// retry (re)opens the transfer at the current offset, waiting between
+// tries, until it succeeds or runs out of them. cause is the error that
+// broke off the transfer, nil when opening it the first time.
+func (b *resumableBody) retry(cause error) error {
+    if b.body != nil {
+        b.body.Close()
+        b.body = nil
+    }
+    for {
+        if cause != nil {
+            b.tries++
+            if b.tries > b.s.retries() {
+                return fmt.Errorf("fetching %s: giving up after %d tries: %v", redactURL(b.s.URL(b.name)), b.tries, cause)
+            }
+            wait := b.s.backoff(b.tries)
+            logger.Warn("fetch failed, retrying", "url", redactURL(b.s.URL(b.name)), "offset", b.read, "backoff", wait, "err", cause)
+            time.Sleep(wait)
+        }
+        err := b.open()
+        if err == nil {
+            return nil
+        }
+        if _, ok := err.(permanentError); ok {
+            return err
+        }
+        cause = err
+    }
+}
+
+// open requests the file from b.read on, ready to be read.
+func (b *resumableBody) open() error {
+    url := redactURL(b.s.URL(b.name))
+    req, err := http.NewRequest("GET", b.s.URL(b.name), nil)
+    if err != nil {
+        return permanentError{err}
+    }
+    ranged := b.read > 0 && b.ranges
+    if ranged {
+        req.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.read))
+        req.Header.Set("Accept-Encoding", "identity")
+    } else {
+        req.Header.Set("Accept-Encoding", strings.Join(codecNames(), ", "))
+    }
+    resp, err := b.s.client().Do(req)
+    if err != nil {
+        return err
+    }
+    switch {
+    case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+        resp.Body.Close()
+        return permanentError{&os.PathError{Op: "fetch", Path: url, Err: os.ErrNotExist}}
+    case ranged && resp.StatusCode == http.StatusPartialContent:
+        if start, ok := contentRangeStart(resp.Header.Get("Content-Range")); !ok || start != b.read {
+            resp.Body.Close()
+            return permanentError{fmt.Errorf("fetching %s: asked for bytes from %d, got %q", url, b.read, resp.Header.Get("Content-Range"))}
+        }
+        b.body = resp.Body
+        return nil
+    case resp.StatusCode != http.StatusOK:
+        resp.Body.Close()
+        err := fmt.Errorf("fetching %s: %s", url, resp.Status)
+        if resp.StatusCode/100 == 4 {
+            return permanentError{err}
+        }
+        return err
+    }
+
+    body := resp.Body
+    encoding := resp.Header.Get("Content-Encoding")
+    if encoding == "" || encoding == "identity" {
+        b.ranges = resp.Header.Get("Accept-Ranges") == "bytes"
+    } else {
+        codec, err := CodecByName(encoding)
+        if err == nil && codec == nil {
+            err = fmt.Errorf("unknown codec %q", encoding)
+        }
+        if err != nil {
+            resp.Body.Close()
+            return permanentError{fmt.Errorf("fetching %s: %v", url, err)}
+        }
+        decoded, err := codec.NewReader(resp.Body)
+        if err != nil {
+            resp.Body.Close()
+            return fmt.Errorf("fetching %s: %v", url, err)
+        }
+        body = &decodedBody{decoded, resp.Body}
+    }
+    // The server sent the whole file: skip what was already read.
+    if _, err := io.CopyN(io.Discard, body, b.read); err != nil {
+        body.Close()
+        return err
+    }
+    b.body = body
+    return nil
+}
+
+func (b *resumableBody) Close() error {
+    defer b.release()
+    if b.body == nil {
+        return nil
+    }
+    return b.body.Close()
+}
+
+// contentRangeStart parses the first byte position out of a Content-Range
+// header such as "bytes 100-199/200".
+func contentRangeStart(header string) (int64, bool) {
+    header = strings.TrimPrefix(header, "bytes ")
+    i := strings.IndexByte(header, '-')
+    if i < 0 {
+        return 0, false
+    }
+    start, err := strconv.ParseInt(header[:i], 10, 64)
+    return start, err == nil
+}
+
+// decodedBody reads a response body through its decoder and closes both.
+type decodedBody struct {
+    io.ReadCloser
+    body    io.Closer
+}
+
+func (b *decodedBody) Close() error {
+    b.ReadCloser.Close()
+    return b.body.Close()
+}
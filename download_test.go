@@ -0,0 +1,166 @@
+package main
+
+import (
+    "bytes"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// testContent is a file big enough to be cut off part way.
+var testContent = bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+
+// breakOff sends the first half of content as if it were the whole, then
+// drops the connection.
+func breakOff(w http.ResponseWriter) {
+    w.Header().Set("Content-Length", strconv.Itoa(len(testContent)))
+    w.WriteHeader(http.StatusOK)
+    w.Write(testContent[:len(testContent)/2])
+    w.(http.Flusher).Flush()
+    panic(http.ErrAbortHandler)
+}
+
+// quietFetches keeps a test's retry warnings out of its output.
+func quietFetches(t *testing.T) {
+    saved := logger
+    logger = NewLogger(io.Discard, LevelError, false)
+    t.Cleanup(func() {logger = saved})
+}
+
+// readURL opens name on the test server at url and reads all of it.
+func readURL(url, name string) ([]byte, error) {
+    s := &HTTPStorage{Host: strings.TrimPrefix(url, "http://"), Backoff: time.Millisecond}
+    r, err := s.Open(name)
+    if err != nil {
+        return nil, err
+    }
+    defer r.Close()
+    return io.ReadAll(r)
+}
+
+// requestLog records the Range header of every request a test server gets.
+type requestLog struct {
+    mu      sync.Mutex
+    ranges  []string
+}
+
+func (l *requestLog) add(r *http.Request) int {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.ranges = append(l.ranges, r.Header.Get("Range"))
+    return len(l.ranges)
+}
+
+func TestHTTPStorageResumesWithRange(t *testing.T) {
+    quietFetches(t)
+    var log requestLog
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Accept-Ranges", "bytes")
+        if log.add(r) == 1 {
+            breakOff(w)
+        }
+        http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(testContent))
+    }))
+    defer srv.Close()
+    data, err := readURL(srv.URL, "file.db")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(data, testContent) {
+        t.Errorf("fetched %d bytes that differ from the %d served", len(data), len(testContent))
+    }
+    want := []string{"", "bytes=" + strconv.Itoa(len(testContent)/2) + "-"}
+    if strings.Join(log.ranges, ",") != strings.Join(want, ",") {
+        t.Errorf("requests asked for ranges %q, want %q", log.ranges, want)
+    }
+}
+
+func TestHTTPStorageResumesWithoutRange(t *testing.T) {
+    quietFetches(t)
+    for _, advertise := range []bool{false, true} {
+        var log requestLog
+        srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            // A server that says it takes ranges may still send the whole
+            // file back.
+            if advertise {
+                w.Header().Set("Accept-Ranges", "bytes")
+            }
+            if log.add(r) == 1 {
+                breakOff(w)
+            }
+            w.Write(testContent)
+        }))
+        data, err := readURL(srv.URL, "file.db")
+        if err != nil {
+            t.Errorf("advertising ranges %v: %v", advertise, err)
+        } else if !bytes.Equal(data, testContent) {
+            t.Errorf("advertising ranges %v: fetched %d bytes that differ from the %d served", advertise, len(data), len(testContent))
+        }
+        if len(log.ranges) != 2 || advertise == (log.ranges[1] == "") {
+            t.Errorf("advertising ranges %v: requests asked for ranges %q", advertise, log.ranges)
+        }
+        srv.Close()
+    }
+}
+
+func TestHTTPStorageGivesUp(t *testing.T) {
+    quietFetches(t)
+    var log requestLog
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        log.add(r)
+        breakOff(w)
+    }))
+    defer srv.Close()
+    s := &HTTPStorage{Host: strings.TrimPrefix(srv.URL, "http://"), Retries: 2, Backoff: time.Millisecond}
+    r, err := s.Open("file.db")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer r.Close()
+    if _, err := io.ReadAll(r); err == nil || !strings.Contains(err.Error(), "giving up after 3 tries") {
+        t.Errorf("reading a file that always breaks off: %v, want to give up", err)
+    }
+    if len(log.ranges) != 3 {
+        t.Errorf("made %d requests, want 3", len(log.ranges))
+    }
+}
+
+func TestHTTPStorageLimitsFetchesPerHost(t *testing.T) {
+    defer func(n int) {MaxFetchesPerHost = n}(MaxFetchesPerHost)
+    MaxFetchesPerHost = 2
+    var mu sync.Mutex
+    running, most := 0, 0
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        mu.Lock()
+        running++
+        if running > most {
+            most = running
+        }
+        mu.Unlock()
+        time.Sleep(20 * time.Millisecond)
+        mu.Lock()
+        running--
+        mu.Unlock()
+        w.Write([]byte("data"))
+    }))
+    defer srv.Close()
+    var wg sync.WaitGroup
+    for i := 0; i < 6; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if _, err := readURL(srv.URL, "file.db"); err != nil {
+                t.Error(err)
+            }
+        }()
+    }
+    wg.Wait()
+    if most != 2 {
+        t.Errorf("the host served %d fetches at once, want %d", most, MaxFetchesPerHost)
+    }
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "sync"
+    "time"
+)
+
+// reduceExecutor runs the key groups of a reduce task on at most Parallel
+// goroutines at a time. The task feeds it the sorted input one value at a
+// time; each group's reducer gets its values as they are read and its
+// output is held until a single writer inserts it. With Ordered set the
+// writer inserts groups in the order they started, so the output database
+// comes out in key order; otherwise it inserts them as they finish.
+//
+// A group's slot is freed only once its output is written, so no more than
+// Parallel groups are ever running or waiting to be written.
+type reduceExecutor struct {
+    task        *ReduceTask
+    ctx         *TaskContext
+    client      Interface
+    stmt        *sql.Stmt
+    ordered     bool
+
+    slots       chan struct{}
+    results     chan groupResult
+    written     chan struct{}
+    reducers    sync.WaitGroup
+
+    seq         int
+    input       chan string
+
+    mu          sync.Mutex
+    failure     error
+}
+
+type groupResult struct {
+    seq     int
+    key     string
+    pairs   []Pair
+    err     error
+}
+
+func newReduceExecutor(task *ReduceTask, ctx *TaskContext, client Interface, stmt *sql.Stmt, parallel int, ordered bool) *reduceExecutor {
+    if parallel < 1 {
+        parallel = 1
+    }
+    e := &reduceExecutor{
+        task: task, ctx: ctx, client: client, stmt: stmt, ordered: ordered,
+        slots:      make(chan struct{}, parallel),
+        results:    make(chan groupResult, parallel),
+        written:    make(chan struct{}),
+    }
+    go e.write()
+    return e
+}
+
+// Start begins the group of key, ending the one before it. It waits for a
+// free slot.
+func (e *reduceExecutor) Start(key string) {
+    if e.input != nil {
+        close(e.input)
+    }
+    e.slots <- struct{}{}
+    e.input = make(chan string, 100)
+    e.reducers.Add(1)
+    go e.reduce(e.seq, key, e.input)
+    e.seq++
+}
+
+// Add hands a value to the current group.
+func (e *reduceExecutor) Add(value string) {e.input <- value}
+
+func (e *reduceExecutor) reduce(seq int, key string, input chan string) {
+    defer e.reducers.Done()
+    pairs, err := collectCall(func(output chan<- Pair) error {
+        return runReduce(e.ctx, e.client, key, input, output)
+    })
+    // A reducer that failed or returned early leaves values behind; take
+    // them so the task can go on reading.
+    for range input {
+    }
+    if err != nil {
+        err = &UserError{Phase: "reduce", Key: key, Err: err}
+    }
+    e.results <- groupResult{seq: seq, key: key, pairs: pairs, err: err}
+}
+
+// write inserts the output of finished groups, in order when asked to, and
+// frees their slots. After the first failure it keeps freeing slots without
+// writing so the task is never left waiting.
+func (e *reduceExecutor) write() {
+    defer close(e.written)
+    pending := make(map[int]groupResult)
+    next := 0
+    for res := range e.results {
+        if !e.ordered {
+            e.insert(res)
+            continue
+        }
+        pending[res.seq] = res
+        for {
+            res, ok := pending[next]
+            if !ok {
+                break
+            }
+            delete(pending, next)
+            e.insert(res)
+            next++
+        }
+    }
+}
+
+func (e *reduceExecutor) insert(res groupResult) {
+    defer func() { <-e.slots }()
+    if e.Failed() {
+        return
+    }
+    if res.err != nil {
+        e.fail(res.err)
+        return
+    }
+    for _, pair := range res.pairs {
+        start := time.Now()
+        if _, err := e.stmt.Exec(pair.Key, pair.Value); err != nil {
+            e.fail(fmt.Errorf("writing output of key %q: %v", res.key, err))
+            return
+        }
+        metricInsertSeconds.ObserveSince(start)
+        e.task.Counters.Increment(CounterReduceOutputRecords, 1)
+        metricRecordsEmitted.Inc("reduce")
+    }
+    e.task.Progress.Advance(1)
+}
+
+func (e *reduceExecutor) fail(err error) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    if e.failure == nil {
+        e.failure = err
+    }
+}
+
+// Failed reports whether a group has failed, after which the task can stop
+// feeding the executor.
+func (e *reduceExecutor) Failed() bool {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    return e.failure != nil
+}
+
+// Close ends the last group and waits until every group has been reduced
+// and written. It returns the first failure.
+func (e *reduceExecutor) Close() error {
+    if e.input != nil {
+        close(e.input)
+        e.input = nil
+    }
+    e.reducers.Wait()
+    close(e.results)
+    <-e.written
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    return e.failure
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+// Job is what the coordinator knows about a running job. It turns the
+// map and reduce tasks into scheduler phases whose attempts write through
+// the job's OutputCommitter. Attempts scheduled on Address run in this
+// process, and those scheduled on any other worker run in the worker
+// process there (see remote.go).
+type Job struct {
+    ID          string
+    M, R        int
+    Address     string
+    TempDir     string
+    Store       Storage
+
+    // InputTags are the tags of the job's inputs when it reads several,
+    // each split M ways; map task n reads split n of every one of them.
+    InputTags   []string
+
+    // InputMappers name the registered mappers of the tagged inputs that
+    // have their own, by tag.
+    InputMappers    map[string]string
+    CacheFiles  []string
+    Client      Interface
+    Status      *JobStatus
+    Log         *Logger
+    Committer   *OutputCommitter
+    Journal     *Journal
+
+    // Artifacts, when set, is told about every file a task commits so
+    // that /data/ serves it.
+    Artifacts   *ArtifactServer
+
+    // Tasks fetch the splits, side files and map output they read over
+    // HTTP from the host serving them, like a worker on another machine
+    // would. DirectReads has them read Store instead, for workers that
+    // share its disk.
+    DirectReads bool
+
+    // FailedMaps are the map tasks the map phase gave up on. Reduce tasks
+    // go without their output.
+    FailedMaps  map[int]bool
+
+    // ReduceParallel and OrderedOutput are passed on to every reduce task.
+    ReduceParallel  int
+    OrderedOutput   bool
+
+    // Codec compresses the map output files, nil to leave them plain.
+    // Format is the format they are written in, FormatSQLite or
+    // FormatRecords.
+    Codec       Codec
+    Format      string
+
+    // With SkipBadRecords set, attempts after the first SkipAfter of a task
+    // skip the records user code fails on, up to MaxSkippedRecords of them.
+    SkipBadRecords      bool
+    SkipAfter           int
+    MaxSkippedRecords   int64
+
+    mu          sync.Mutex
+    attempts    map[string]attemptHandles
+    last        map[string]int
+    checksums   map[string]string
+
+    // MaxFetchFailures is how many times reduce attempts may fail to fetch
+    // a map task's output before the map task is run again. Output that is
+    // missing or corrupt has it run again straight away.
+    MaxFetchFailures    int
+
+    // maps is the map phase, kept to run a map task again when its output
+    // is lost.
+    maps        *Phase
+    mapFiles    func(n int) []string
+    rerunMu     sync.Mutex
+    rerun       map[int]time.Time
+    fetchFailures map[int]int
+}
+
+// attemptHandles are the counters and progress of one attempt. They become
+// the task's own once the attempt wins.
+type attemptHandles struct {
+    counters    *Counters
+    progress    *TaskProgress
+}
+
+// startAttempt gives an attempt its output directory and its own counters
+// and progress. The status page follows the first attempt until one wins.
+func (job *Job) startAttempt(ts *TaskStatus, phase string, n, attempt int) (string, attemptHandles, error) {
+    h := attemptHandles{counters: NewCounters(), progress: NewTaskProgress()}
+    dir, err := job.Committer.SetupAttempt(phase, n, attempt)
+    if err != nil {
+        return dir, h, err
+    }
+    job.mu.Lock()
+    if job.attempts == nil {
+        job.attempts = make(map[string]attemptHandles)
+        job.last = make(map[string]int)
+    }
+    job.attempts[attemptID(job.ID, phase, n, attempt)] = h
+    if key := fmt.Sprintf("%s_%d", phase, n); attempt > job.last[key] {
+        job.last[key] = attempt
+    }
+    job.mu.Unlock()
+    if attempt == 1 {
+        ts.SetAttempt(h.counters, h.progress)
+    }
+    return dir, h, nil
+}
+
+// taskStore is the store tasks read from, nil when they fetch from /data/.
+func (job *Job) taskStore() Storage {
+    if job.DirectReads {
+        return job.Store
+    }
+    return nil
+}
+
+// skipping reports whether an attempt runs in skipping mode.
+func (job *Job) skipping(attempt int) bool {
+    return job.SkipBadRecords && attempt > job.SkipAfter
+}
+
+// commit makes the files of a winning attempt the task's output, along with
+// its quarantine table if it skipped any records.
+func (job *Job) commit(ts *TaskStatus, phase string, n, attempt int, files []string) error {
+    if filesExist(job.Committer.AttemptDir(phase, n, attempt), []string{quarantineFile(job.ID, phase, n)}) {
+        files = append(files[:len(files):len(files)], quarantineFile(job.ID, phase, n))
+    }
+    checksums, err := job.Committer.CommitAttempt(phase, n, attempt, files)
+    if err != nil {
+        return err
+    }
+    job.addChecksums(checksums)
+    job.register(phase, n, files)
+    job.mu.Lock()
+    h := job.attempts[attemptID(job.ID, phase, n, attempt)]
+    delete(job.attempts, attemptID(job.ID, phase, n, attempt))
+    job.mu.Unlock()
+    ts.SetAttempt(h.counters, h.progress)
+    if err := job.Journal.Record(phase, n, job.Address, h.counters.Snapshot(), checksums); err != nil {
+        job.Log.Warn("journaling task", "phase", phase, "task", n, "err", err)
+    }
+    return nil
+}
+
+// completed returns the tasks of phase that the journal says an earlier
+// run finished and whose output is still in the store. Their status entries
+// get back the counters they finished with.
+func (job *Job) completed(phase string, status []*TaskStatus, files func(n int) []string) map[int]bool {
+    entries, err := job.Journal.Entries(phase)
+    if err != nil {
+        job.Log.Warn("reading journal", "phase", phase, "err", err)
+        return nil
+    }
+    done := make(map[int]bool)
+    for n, e := range entries {
+        if n < 0 || n >= len(status) || !exists(job.Store, files(n)) {
+            continue
+        }
+        counters := NewCounters()
+        for name, v := range e.Counters {
+            counters.Increment(name, v)
+        }
+        status[n].SetAttempt(counters, nil)
+        job.addChecksums(e.Checksums)
+        job.register(phase, n, files(n))
+        done[n] = true
+    }
+    if len(done) > 0 {
+        job.Log.Info("resuming", "phase", phase, "completed", len(done))
+    }
+    return done
+}
+
+// register has the committed files of task n of phase served. A map task's
+// files come one per reduce partition, and a reduce task's output is its
+// own partition; anything after them, such as a quarantine table, belongs
+// to no partition.
+func (job *Job) register(phase string, n int, files []string) {
+    for i, file := range files {
+        partition := -1
+        switch {
+        case phase == "map" && i < job.R:
+            partition = i
+        case phase == "reduce" && i == 0:
+            partition = n
+        }
+        job.Artifacts.Register(Artifact{Job: job.ID, Phase: phase, Task: n, Partition: partition, Name: file})
+    }
+}
+
+// addChecksums records the checksums of committed files, by name.
+func (job *Job) addChecksums(checksums map[string]string) {
+    job.mu.Lock()
+    defer job.mu.Unlock()
+    if job.checksums == nil {
+        job.checksums = make(map[string]string)
+    }
+    for name, sum := range checksums {
+        job.checksums[name] = sum
+    }
+}
+
+// checksumsOf returns the recorded checksums of the named files.
+func (job *Job) checksumsOf(names []string) map[string]string {
+    job.mu.Lock()
+    defer job.mu.Unlock()
+    checksums := make(map[string]string)
+    for _, name := range names {
+        if sum, ok := job.checksums[name]; ok {
+            checksums[name] = sum
+        }
+    }
+    return checksums
+}
+
+// mapOutputLost is how a reduce attempt started at since reports that it
+// could not get a good copy of a map task's output. The map task is run
+// again, outside the scheduler, once its output is known to be missing or
+// corrupt or has failed to fetch MaxFetchFailures times, unless another
+// reduce attempt already had it run again since then.
+func (job *Job) mapOutputLost(lost *MapOutputError, since time.Time) error {
+    job.rerunMu.Lock()
+    defer job.rerunMu.Unlock()
+    if job.rerun == nil {
+        job.rerun = make(map[int]time.Time)
+        job.fetchFailures = make(map[int]int)
+    }
+    n := lost.Map
+    if job.rerun[n].After(since) {
+        return nil
+    }
+    job.fetchFailures[n]++
+    var corrupt *ChecksumError
+    lostForGood := errors.As(lost, &corrupt) || errors.Is(lost, os.ErrNotExist)
+    max := job.MaxFetchFailures
+    if max <= 0 {
+        max = 3
+    }
+    if !lostForGood && job.fetchFailures[n] < max {
+        job.Log.Warn("could not fetch map output", "task", n, "failures", job.fetchFailures[n], "err", lost.Err)
+        return nil
+    }
+    job.mu.Lock()
+    attempt := job.last[fmt.Sprintf("map_%d", n)] + 1
+    job.mu.Unlock()
+    job.Log.Warn("running map task again", "task", n, "attempt", attempt)
+    // What reducers could not use is deleted rather than served until the
+    // new output replaces it.
+    job.Artifacts.PurgeTask(job.ID, "map", n)
+    for _, name := range job.mapFiles(n) {
+        job.Store.Remove(name)
+    }
+    if err := job.maps.Run(n, attempt, job.Address); err != nil {
+        job.maps.Discard(n, attempt)
+        return err
+    }
+    if err := job.maps.Commit(n, attempt); err != nil {
+        return err
+    }
+    job.rerun[n] = time.Now()
+    job.fetchFailures[n] = 0
+    return nil
+}
+
+func filesExist(dir string, files []string) bool {
+    for _, file := range files {
+        if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+            return false
+        }
+    }
+    return true
+}
+
+// discard removes what a failed or losing attempt wrote.
+func (job *Job) discard(phase string, n, attempt int) {
+    job.mu.Lock()
+    delete(job.attempts, attemptID(job.ID, phase, n, attempt))
+    job.mu.Unlock()
+    if err := job.Committer.AbortAttempt(phase, n, attempt); err != nil {
+        job.Log.Warn("discarding attempt", "attempt", attemptID(job.ID, phase, n, attempt), "err", err)
+    }
+}
+
+func (job *Job) mapPhase() *Phase {
+    p := &Phase{Name: "map", N: job.M}
+    for i := 0; i < job.M; i++ {
+        p.Status = append(p.Status, job.Status.AddTask("map", i, job.Address, NewCounters(), NewTaskProgress()))
+    }
+    p.Run = func(n, attempt int, worker string) error {
+        dir, h, err := job.startAttempt(p.Status[n], "map", n, attempt)
+        if err != nil {
+            return err
+        }
+        task := MapTask{
+            M: job.M, R: job.R, N: n, SourceHost: job.Address, Inputs: job.mapInputs(),
+            CacheHost: job.Address, CacheFiles: job.CacheFiles,
+            Counters: h.counters, Progress: h.progress,
+            JobID: job.ID, Attempt: attempt, OutputDir: dir, Store: job.taskStore(),
+            SkipBadRecords: job.skipping(attempt), MaxSkippedRecords: job.MaxSkippedRecords,
+            Codec: job.Codec, Format: job.Format, Checksums: job.checksumsOf(append(job.splits(n), job.cacheFiles()...)),
+        }
+        if worker != job.Address {
+            return job.runRemote(worker, RemoteAttempt{Map: &task}, h)
+        }
+        return task.Process(job.TempDir, job.Client)
+    }
+    files := func(n int) []string {
+        var files []string
+        for r := 0; r < job.R; r++ {
+            files = append(files, compressedName(intermediateFile(mapOutputFile(job.ID, n, r), job.Format), job.Codec))
+        }
+        return files
+    }
+    p.Commit = func(n, attempt int) error {
+        return job.commit(p.Status[n], "map", n, attempt, files(n))
+    }
+    p.Completed = job.completed("map", p.Status, files)
+    job.mapFiles = files
+    p.Discard = func(n, attempt int) {job.discard("map", n, attempt)}
+    job.maps = p
+    return p
+}
+
+// mapOutputs are the names of the files holding partition r of the output
+// of every map task.
+func (job *Job) mapOutputs(r int) []string {
+    var names []string
+    for i := 0; i < job.M && job.mapFiles != nil; i++ {
+        names = append(names, job.mapFiles(i)[r])
+    }
+    return names
+}
+
+// mapInputs are the tagged inputs of every map task, nil when the job has a
+// single untagged one. Each is mapped by its own mapper when it names
+// one, and by the job's client otherwise.
+func (job *Job) mapInputs() []MapInput {
+    var inputs []MapInput
+    for _, tag := range job.InputTags {
+        inputs = append(inputs, MapInput{Tag: tag, SourceHost: job.Address, MapperName: job.InputMappers[tag]})
+    }
+    return inputs
+}
+
+// splits are the names of the source splits map task n reads.
+func (job *Job) splits(n int) []string {return mapSplitFiles(job.ID, job.InputTags, n)}
+
+// cacheFiles are the names the job's cache files are published under.
+func (job *Job) cacheFiles() []string {
+    var names []string
+    for _, name := range job.CacheFiles {
+        names = append(names, cacheFile(job.ID, name))
+    }
+    return names
+}
+
+func (job *Job) reducePhase() *Phase {
+    p := &Phase{Name: "reduce", N: job.R}
+    for j := 0; j < job.R; j++ {
+        p.Status = append(p.Status, job.Status.AddTask("reduce", j, job.Address, NewCounters(), NewTaskProgress()))
+    }
+    p.Run = func(n, attempt int, worker string) error {
+        started := time.Now()
+        dir, h, err := job.startAttempt(p.Status[n], "reduce", n, attempt)
+        if err != nil {
+            return err
+        }
+        task := ReduceTask{
+            M: job.M, R: job.R, N: n, SourceHosts: []string{job.Address},
+            CacheHost: job.Address, CacheFiles: job.CacheFiles,
+            Counters: h.counters, Progress: h.progress,
+            JobID: job.ID, Attempt: attempt, OutputDir: dir, Store: job.taskStore(), SkipMaps: job.FailedMaps,
+            Parallel: job.ReduceParallel, OrderedOutput: job.OrderedOutput,
+            SkipBadRecords: job.skipping(attempt), MaxSkippedRecords: job.MaxSkippedRecords,
+            Codec: job.Codec, Format: job.Format, Checksums: job.checksumsOf(append(job.mapOutputs(n), job.cacheFiles()...)),
+        }
+        if worker != job.Address {
+            err = job.runRemote(worker, RemoteAttempt{Reduce: &task}, h)
+        } else {
+            err = task.Process(job.TempDir, job.Client)
+        }
+        var lost *MapOutputError
+        if errors.As(err, &lost) && job.maps != nil {
+            // The scheduler retries this attempt, which reads the map
+            // task's new output if it was run again.
+            if rerr := job.mapOutputLost(lost, started); rerr != nil {
+                job.Log.Error("running map task again", "task", lost.Map, "err", rerr)
+            }
+        }
+        return err
+    }
+    files := func(n int) []string {return []string{reduceOutputFile(job.ID, n)}}
+    p.Commit = func(n, attempt int) error {
+        return job.commit(p.Status[n], "reduce", n, attempt, files(n))
+    }
+    p.Completed = job.completed("reduce", p.Status, files)
+    p.Discard = func(n, attempt int) {job.discard("reduce", n, attempt)}
+    return p
+}
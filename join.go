@@ -0,0 +1,275 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "sync"
+    "unicode"
+)
+
+// tagSeparator sits between a source tag and the value it was attached to.
+// The ASCII unit separator keeps it out of the way of ordinary text values.
+const tagSeparator = "\x1f"
+
+type JoinType int
+
+const (
+    InnerJoin JoinType = iota
+    LeftOuterJoin
+    FullOuterJoin
+)
+
+func (t JoinType) String() string {
+    switch t {
+    case InnerJoin:
+        return "inner"
+    case LeftOuterJoin:
+        return "left outer"
+    case FullOuterJoin:
+        return "full outer"
+    }
+    return fmt.Sprintf("JoinType(%d)", int(t))
+}
+
+func tagValue(tag, value string) string {return tag + tagSeparator + value}
+
+// splitTaggedValue undoes tagValue. Values that were never tagged come back
+// with an empty tag.
+func splitTaggedValue(value string) (tag, rest string) {
+    i := strings.Index(value, tagSeparator)
+    if i < 0 {
+        return "", value
+    }
+    return value[:i], value[i+len(tagSeparator):]
+}
+
+// tagOutput copies pairs from in to out with every value tagged, closing out
+// once the mapper closes in.
+func tagOutput(tag string, in <-chan Pair, out chan<- Pair) {
+    for pair := range in {
+        out <- Pair{Key: pair.Key, Value: tagValue(tag, pair.Value)}
+    }
+    close(out)
+}
+
+// groupByTag drains values and buckets them by the tag of the input they
+// came from.
+func groupByTag(values <-chan string) map[string][]string {
+    groups := make(map[string][]string)
+    for v := range values {
+        tag, value := splitTaggedValue(v)
+        groups[tag] = append(groups[tag], value)
+    }
+    return groups
+}
+
+// JoinReducer is a reduce-side join of the inputs tagged Left and Right.
+// For each key it emits one pair per matching combination of left and right
+// values, joined by Separator (a tab when empty). Outer joins emit an empty
+// string for the missing side. Its Map is the identity, so inputs that are
+// already keyed on the join column need no Mapper of their own.
+type JoinReducer struct {
+    Type        JoinType
+    Left, Right string
+    Separator   string
+}
+
+func (j JoinReducer) Map(key, value string, output chan<- Pair) error {
+    output <- Pair{Key: key, Value: value}
+    close(output)
+    return nil
+}
+
+func (j JoinReducer) Reduce(key string, values <-chan string, output chan<- Pair) error {
+    defer close(output)
+    sep := j.Separator
+    if sep == "" {
+        sep = "\t"
+    }
+    groups := groupByTag(values)
+    left, right := groups[j.Left], groups[j.Right]
+
+    switch {
+    case len(left) > 0 && len(right) > 0:
+        for _, l := range left {
+            for _, r := range right {
+                output <- Pair{Key: key, Value: l + sep + r}
+            }
+        }
+    case len(left) > 0 && j.Type != InnerJoin:
+        for _, l := range left {
+            output <- Pair{Key: key, Value: l + sep}
+        }
+    case len(right) > 0 && j.Type == FullOuterJoin:
+        for _, r := range right {
+            output <- Pair{Key: key, Value: sep + r}
+        }
+    }
+    return nil
+}
+
+// IdentityMapper emits every pair as it is read.
+type IdentityMapper struct{}
+
+func (IdentityMapper) Map(key, value string, output chan<- Pair) error {
+    output <- Pair{Key: key, Value: value}
+    close(output)
+    return nil
+}
+
+// SwapMapper emits every pair with its key and value swapped, which keys an
+// input on a column it holds as values, e.g. events on the user they are of.
+type SwapMapper struct{}
+
+func (SwapMapper) Map(key, value string, output chan<- Pair) error {
+    output <- Pair{Key: value, Value: key}
+    close(output)
+    return nil
+}
+
+var mappers = struct {
+    sync.Mutex
+    m   map[string]Mapper
+}{m: map[string]Mapper{"identity": IdentityMapper{}, "swap": SwapMapper{}, "words": Client{}}}
+
+// RegisterMapper makes a mapper available to -input under name, replacing
+// any mapper of the same name. Tasks find their mappers by name, so every
+// process of a job, workers included, has to register the same ones. Like
+// a tag, a name may only hold letters, digits and dashes.
+func RegisterMapper(name string, m Mapper) {
+    mappers.Lock()
+    defer mappers.Unlock()
+    mappers.m[name] = m
+}
+
+// MapperByName returns the named mapper, or nil for "".
+func MapperByName(name string) (Mapper, error) {
+    if name == "" {
+        return nil, nil
+    }
+    mappers.Lock()
+    defer mappers.Unlock()
+    if m, ok := mappers.m[name]; ok {
+        return m, nil
+    }
+    return nil, fmt.Errorf("unknown mapper %q", name)
+}
+
+// ParseJoinType parses inner, left or full, as given to -join.
+func ParseJoinType(s string) (JoinType, error) {
+    switch strings.ToLower(s) {
+    case "inner":
+        return InnerJoin, nil
+    case "left", "left outer":
+        return LeftOuterJoin, nil
+    case "full", "full outer":
+        return FullOuterJoin, nil
+    }
+    return InnerJoin, fmt.Errorf("unknown join type %q", s)
+}
+
+// JobInput is one source of a job: where it is, and the tag its values
+// carry when the job reads several sources. A tagged input may name a
+// registered Mapper to be read with instead of the job's client.
+type JobInput struct {
+    Tag         string
+    Location    string
+    Mapper      string
+}
+
+// InputList is the repeatable -input flag. A value is a location, or
+// tag=location for a tagged input; a job with more than one input needs a
+// tag on each. tag:mapper=location reads a tagged input with the mapper
+// registered as mapper.
+type InputList []JobInput
+
+func (l *InputList) String() string {
+    var values []string
+    for _, in := range *l {
+        switch {
+        case in.Mapper != "":
+            values = append(values, in.Tag+":"+in.Mapper+"="+in.Location)
+        case in.Tag != "":
+            values = append(values, in.Tag+"="+in.Location)
+        default:
+            values = append(values, in.Location)
+        }
+    }
+    return strings.Join(values, ",")
+}
+
+func (l *InputList) Set(value string) error {
+    in := JobInput{Location: value}
+    if i := strings.IndexByte(value, '='); i > 0 {
+        tag, mapper := value[:i], ""
+        if j := strings.IndexByte(tag, ':'); j >= 0 {
+            tag, mapper = tag[:j], tag[j+1:]
+        }
+        if validTag(tag) && (mapper == "" || validTag(mapper)) {
+            if _, err := MapperByName(mapper); err != nil {
+                return err
+            }
+            in = JobInput{Tag: tag, Location: value[i+1:], Mapper: mapper}
+        }
+    }
+    for _, other := range *l {
+        switch {
+        case in.Tag == "" || other.Tag == "":
+            return fmt.Errorf("every input of a job with more than one needs a tag")
+        case in.Tag == other.Tag:
+            return fmt.Errorf("two inputs tagged %q", in.Tag)
+        }
+    }
+    *l = append(*l, in)
+    return nil
+}
+
+// validTag reports whether tag can name an input: it ends up in file
+// names, so only letters, digits and dashes are allowed.
+func validTag(tag string) bool {
+    for _, r := range tag {
+        if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' {
+            return false
+        }
+    }
+    return tag != ""
+}
+
+// Tags returns the tags of the inputs, or nil for a single untagged one.
+func (l InputList) Tags() []string {
+    var tags []string
+    for _, in := range l {
+        if in.Tag != "" {
+            tags = append(tags, in.Tag)
+        }
+    }
+    return tags
+}
+
+// Mappers returns the names of the mappers of the inputs that have their
+// own, by tag.
+func (l InputList) Mappers() map[string]string {
+    names := make(map[string]string)
+    for _, in := range l {
+        if in.Mapper != "" {
+            names[in.Tag] = in.Mapper
+        }
+    }
+    return names
+}
+
+// Join returns the reducer that joins the inputs the way join names. It
+// takes two tagged inputs, the first being the left side.
+func (l InputList) Join(join string) (JoinReducer, error) {
+    if join == "" {
+        return JoinReducer{}, fmt.Errorf("tagged inputs can only be joined")
+    }
+    t, err := ParseJoinType(join)
+    if err != nil {
+        return JoinReducer{}, err
+    }
+    if len(l.Tags()) != 2 {
+        return JoinReducer{}, fmt.Errorf("a join needs two tagged inputs, not %d", len(l.Tags()))
+    }
+    return JoinReducer{Type: t, Left: l[0].Tag, Right: l[1].Tag}, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "testing"
+)
+
+// joinKey reduces key over values with j and returns the joined values.
+func joinKey(t *testing.T, j JoinReducer, key string, values ...string) []string {
+    t.Helper()
+    in := make(chan string, len(values))
+    for _, v := range values {
+        in <- v
+    }
+    close(in)
+    out := make(chan Pair, 100)
+    if err := j.Reduce(key, in, out); err != nil {
+        t.Fatal(err)
+    }
+    var joined []string
+    for p := range out {
+        if p.Key != key {
+            t.Errorf("joining %s emitted key %s", key, p.Key)
+        }
+        joined = append(joined, p.Value)
+    }
+    sort.Strings(joined)
+    return joined
+}
+
+func TestJoinReducer(t *testing.T) {
+    both := []string{tagValue("users", "ann"), tagValue("events", "login"), tagValue("events", "logout")}
+    leftOnly := []string{tagValue("users", "bob")}
+    rightOnly := []string{tagValue("events", "crash"), tagValue("events", "reboot")}
+    for _, tt := range []struct {
+        join                        JoinType
+        both, leftOnly, rightOnly   string
+    }{
+        {InnerJoin, "[ann\tlogin ann\tlogout]", "[]", "[]"},
+        {LeftOuterJoin, "[ann\tlogin ann\tlogout]", "[bob\t]", "[]"},
+        {FullOuterJoin, "[ann\tlogin ann\tlogout]", "[bob\t]", "[\tcrash \treboot]"},
+    } {
+        j := JoinReducer{Type: tt.join, Left: "users", Right: "events"}
+        if got := fmt.Sprint(joinKey(t, j, "u1", both...)); got != tt.both {
+            t.Errorf("%s join of a key on both sides: %q, want %q", tt.join, got, tt.both)
+        }
+        if got := fmt.Sprint(joinKey(t, j, "u2", leftOnly...)); got != tt.leftOnly {
+            t.Errorf("%s join of a key only on the left: %q, want %q", tt.join, got, tt.leftOnly)
+        }
+        if got := fmt.Sprint(joinKey(t, j, "u3", rightOnly...)); got != tt.rightOnly {
+            t.Errorf("%s join of a key only on the right: %q, want %q", tt.join, got, tt.rightOnly)
+        }
+    }
+
+    // Values from inputs the join is not over are left out.
+    j := JoinReducer{Type: FullOuterJoin, Left: "users", Right: "events", Separator: ","}
+    if got := fmt.Sprint(joinKey(t, j, "u1", tagValue("users", "ann"), tagValue("other", "x"), "untagged")); got != "[ann,]" {
+        t.Errorf("joining with values of other inputs: %q, want [ann,]", got)
+    }
+}
+
+func TestInputListSet(t *testing.T) {
+    for _, tt := range []struct {
+        values  []string
+        want    string
+        ok      bool
+    }{
+        {[]string{"austen.db"}, "[{ austen.db }]", true},
+        {[]string{"s3://bucket/a=b.db"}, "[{ s3://bucket/a=b.db }]", true},
+        {[]string{"users=users.db", "events:swap=s3://bucket/events.db"}, "[{users users.db } {events s3://bucket/events.db swap}]", true},
+        {[]string{"users:nope=users.db"}, "", false},
+        {[]string{"users=users.db", "users=other.db"}, "", false},
+        {[]string{"users=users.db", "events.db"}, "", false},
+    } {
+        var l InputList
+        var err error
+        for _, v := range tt.values {
+            if err = l.Set(v); err != nil {
+                break
+            }
+        }
+        if (err == nil) != tt.ok {
+            t.Errorf("%q: %v, want ok %v", tt.values, err, tt.ok)
+            continue
+        }
+        if got := fmt.Sprint(l); tt.ok && got != tt.want {
+            t.Errorf("%q: %s, want %s", tt.values, got, tt.want)
+        }
+    }
+    var l InputList
+    l.Set("users=users.db")
+    l.Set("events:swap=events.db")
+    if got := l.String(); got != "users=users.db,events:swap=events.db" {
+        t.Errorf("String() = %q", got)
+    }
+    if got := fmt.Sprint(l.Mappers()); got != "map[events:swap]" {
+        t.Errorf("Mappers() = %s, want map[events:swap]", got)
+    }
+}
+
+func TestMapTaskInputMappers(t *testing.T) {
+    dir := t.TempDir()
+    store := &LocalStorage{Dir: filepath.Join(dir, "store")}
+    if err := os.Mkdir(store.Dir, 0755); err != nil {
+        t.Fatal(err)
+    }
+    for tag, pairs := range map[string][]Pair{
+        "users":    {{"u1", "ann"}, {"u2", "bob"}},
+        "events":   {{"e1", "u1"}, {"e2", "u3"}},
+    } {
+        db, err := createDatabase(store.Path(mapTaggedSourceFile("job", tag, 0)))
+        if err != nil {
+            t.Fatal(err)
+        }
+        for _, p := range pairs {
+            if _, err := db.Exec("INSERT INTO pairs VALUES(?, ?)", p.Key, p.Value); err != nil {
+                t.Fatal(err)
+            }
+        }
+        db.Close()
+    }
+    task := &MapTask{
+        M: 1, R: 1, N: 0, JobID: "job", OutputDir: dir, Store: store, Format: FormatRecords,
+        Inputs: []MapInput{{Tag: "users"}, {Tag: "events", MapperName: "swap"}},
+        Progress: NewTaskProgress(),
+    }
+    join := JoinReducer{Type: FullOuterJoin, Left: "users", Right: "events"}
+    if err := task.Process(dir, join); err != nil {
+        t.Fatal(err)
+    }
+    r, err := OpenRecordFile(filepath.Join(dir, task.outputFile(0)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer r.Close()
+    var got []string
+    for _, p := range readRecords(t, r) {
+        tag, value := splitTaggedValue(p.Value)
+        got = append(got, tag+":"+p.Key+"="+value)
+    }
+    sort.Strings(got)
+    want := "[events:u1=e1 events:u3=e2 users:u1=ann users:u2=bob]"
+    if fmt.Sprint(got) != want {
+        t.Errorf("map output %v, want %s", got, want)
+    }
+
+    task.Inputs[1].MapperName = "nope"
+    if err := task.Process(dir, join); err == nil {
+        t.Errorf("ran an input with an unknown mapper")
+    }
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "time"
+)
+
+// Journal is the coordinator's record of finished work, kept in a local
+// SQLite database so that a coordinator restarted with the same job ID can
+// pick up where the last one stopped. Each row is one finished step: the
+// split (task 0 of phase "split"), or a committed map or reduce task along
+// with where its output lives, its counters and the checksums of its
+// files. A nil *Journal records nothing.
+type Journal struct {
+    db      *sql.DB
+    job     string
+}
+
+type JournalEntry struct {
+    Phase       string
+    N           int
+    Location    string
+    Counters    map[string]int64
+    Checksums   map[string]string
+    Finished    time.Time
+}
+
+func OpenJournal(path, job string) (*Journal, error) {
+    db, err := sql.Open("sqlite3", path+"?_busy_timeout=10000")
+    if err != nil {
+        return nil, err
+    }
+    _, err = db.Exec(`CREATE TABLE IF NOT EXISTS journal(
+        job text, phase text, task integer, location text, counters text, finished text, checksums text,
+        PRIMARY KEY(job, phase, task))`)
+    if err != nil {
+        db.Close()
+        return nil, fmt.Errorf("creating journal table: %v", err)
+    }
+    // Journals written before checksums were recorded lack the column.
+    db.Exec("ALTER TABLE journal ADD COLUMN checksums text")
+    return &Journal{db: db, job: job}, nil
+}
+
+func (j *Journal) Close() error {
+    if j == nil {
+        return nil
+    }
+    return j.db.Close()
+}
+
+// Record notes that task n of phase finished with its output at location.
+func (j *Journal) Record(phase string, n int, location string, counters map[string]int64, checksums map[string]string) error {
+    if j == nil {
+        return nil
+    }
+    data, err := json.Marshal(counters)
+    if err != nil {
+        return err
+    }
+    sums, err := json.Marshal(checksums)
+    if err != nil {
+        return err
+    }
+    _, err = j.db.Exec("INSERT OR REPLACE INTO journal(job, phase, task, location, counters, finished, checksums) values(?, ?, ?, ?, ?, ?, ?)",
+        j.job, phase, n, location, string(data), time.Now().Format(time.RFC3339Nano), string(sums))
+    return err
+}
+
+// Entries returns what the journal has on phase, by task number.
+func (j *Journal) Entries(phase string) (map[int]JournalEntry, error) {
+    entries := make(map[int]JournalEntry)
+    if j == nil {
+        return entries, nil
+    }
+    rows, err := j.db.Query("SELECT task, location, counters, finished, coalesce(checksums, '') FROM journal WHERE job = ? AND phase = ?", j.job, phase)
+    if err != nil {
+        return entries, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        e := JournalEntry{Phase: phase}
+        var counters, finished, checksums string
+        if err := rows.Scan(&e.N, &e.Location, &counters, &finished, &checksums); err != nil {
+            return entries, err
+        }
+        json.Unmarshal([]byte(counters), &e.Counters)
+        json.Unmarshal([]byte(checksums), &e.Checksums)
+        e.Finished, _ = time.Parse(time.RFC3339Nano, finished)
+        entries[e.N] = e
+    }
+    return entries, rows.Err()
+}
+
+// Started reports whether an earlier run of the job left anything behind.
+func (j *Journal) Started() (bool, error) {
+    if j == nil {
+        return false, nil
+    }
+    var count int
+    err := j.db.QueryRow("SELECT count(*) FROM journal WHERE job = ?", j.job).Scan(&count)
+    return count > 0, err
+}
+
+// Forget drops the job from the journal once it has finished for good.
+func (j *Journal) Forget() error {
+    if j == nil {
+        return nil
+    }
+    _, err := j.db.Exec("DELETE FROM journal WHERE job = ?", j.job)
+    return err
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "os"
+    "time"
+)
+
+// Lease makes one coordinator at a time the leader of a job. It is a row in
+// the journal's database, which coordinators sharing a job also share: the
+// leader holds it until an expiry time it keeps pushing forward, and any
+// coordinator may take it over once that time has passed. Expiry times are
+// compared across machines, so their clocks must roughly agree; the TTL
+// should be well above any skew between them.
+type Lease struct {
+    db          *sql.DB
+    job         string
+    Holder      string
+    Address     string
+    TTL         time.Duration
+}
+
+// Lease returns the job's lease as seen by holder, which serves the job's
+// data at address while it leads.
+func (j *Journal) Lease(holder, address string, ttl time.Duration) (*Lease, error) {
+    _, err := j.db.Exec(`CREATE TABLE IF NOT EXISTS lease(
+        job text PRIMARY KEY, holder text, address text, expires integer, outcome text)`)
+    if err != nil {
+        return nil, fmt.Errorf("creating lease table: %v", err)
+    }
+    // Leases taken before outcomes were recorded lack the column.
+    j.db.Exec("ALTER TABLE lease ADD COLUMN outcome text")
+    return &Lease{db: j.db, job: j.job, Holder: holder, Address: address, TTL: ttl}, nil
+}
+
+// What a leader records when it releases the lease: the job either
+// succeeded or failed for good. Either way there is nothing to take over.
+const (
+    JobSucceeded    = "succeeded"
+    JobFailed       = "failed"
+)
+
+// leaseHolder names this coordinator process.
+func leaseHolder() string {
+    host, _ := os.Hostname()
+    return fmt.Sprintf("%s_%d", host, os.Getpid())
+}
+
+// TryAcquire takes the lease if nobody holds it, it has expired or we hold
+// it already, and pushes its expiry TTL into the future. It reports whether
+// we hold the lease afterwards. A lease released by a leader that finished
+// the job is never taken over; see Reset.
+func (l *Lease) TryAcquire() (bool, error) {
+    now := time.Now()
+    res, err := l.db.Exec(`INSERT INTO lease(job, holder, address, expires) VALUES(?, ?, ?, ?)
+        ON CONFLICT(job) DO UPDATE SET holder = excluded.holder, address = excluded.address, expires = excluded.expires
+        WHERE lease.holder = excluded.holder OR (lease.holder != '' AND lease.expires < ?)`,
+        l.job, l.Holder, l.Address, now.Add(l.TTL).UnixNano(), now.UnixNano())
+    if err != nil {
+        return false, err
+    }
+    n, err := res.RowsAffected()
+    return n == 1, err
+}
+
+// Leader returns who holds the lease and until when. ok is false when
+// nobody has taken it yet; holder is empty once the job has finished.
+func (l *Lease) Leader() (holder, address string, expires time.Time, ok bool, err error) {
+    var nanos int64
+    err = l.db.QueryRow("SELECT holder, address, expires FROM lease WHERE job = ?", l.job).Scan(&holder, &address, &nanos)
+    if err == sql.ErrNoRows {
+        return "", "", time.Time{}, false, nil
+    }
+    if err != nil {
+        return "", "", time.Time{}, false, err
+    }
+    return holder, address, time.Unix(0, nanos), true, nil
+}
+
+// interval is how often the lease is renewed, and polled by standbys: a
+// third of its TTL.
+func (l *Lease) interval() time.Duration {
+    if l.TTL < 3*time.Millisecond {
+        return time.Millisecond
+    }
+    return l.TTL / 3
+}
+
+// Hold renews the lease every third of its TTL until stop is closed. If the
+// lease is taken over, or cannot be renewed before it runs out, lost is
+// called: another coordinator may be leading the job by then.
+func (l *Lease) Hold(log *Logger, stop <-chan struct{}, lost func()) {
+    ticker := time.NewTicker(l.interval())
+    defer ticker.Stop()
+    renewed := time.Now()
+    for {
+        select {
+        case <-stop:
+            return
+        case <-ticker.C:
+        }
+        held, err := l.TryAcquire()
+        switch {
+        case err != nil && time.Since(renewed) < l.TTL:
+            log.Warn("renewing lease", "err", err)
+        case err != nil || !held:
+            holder, _, _, _, _ := l.Leader()
+            log.Error("lost lease", "holder", holder, "err", err)
+            lost()
+            return
+        default:
+            renewed = time.Now()
+        }
+    }
+}
+
+// Release gives up the lease and marks the job finished with outcome,
+// JobSucceeded or JobFailed. The leader does so only once the job has
+// ended, which is how standbys learn they are no longer needed.
+func (l *Lease) Release(outcome string) error {
+    _, err := l.db.Exec("UPDATE lease SET holder = '', address = '', expires = 0, outcome = ? WHERE job = ? AND holder = ?", outcome, l.job, l.Holder)
+    return err
+}
+
+// Outcome is what the leader that released the lease recorded, empty while
+// the job has not ended.
+func (l *Lease) Outcome() (string, error) {
+    var outcome sql.NullString
+    err := l.db.QueryRow("SELECT outcome FROM lease WHERE job = ? AND holder = ''", l.job).Scan(&outcome)
+    if err == sql.ErrNoRows {
+        return "", nil
+    }
+    return outcome.String, err
+}
+
+// Reset forgets that an earlier run of the job finished, so that running it
+// again as the primary can take the lease.
+func (l *Lease) Reset() error {
+    _, err := l.db.Exec("DELETE FROM lease WHERE job = ? AND holder = ''", l.job)
+    return err
+}
+
+// Follow is what a standby coordinator does: it polls the lease until it
+// can take it over and, while it waits, tails the journal so the progress
+// of the leader shows up in its log. It reports false if the leader
+// released the lease, meaning the job succeeded or failed for good and
+// there is nothing to take over. A standby started with no leader around takes the lease
+// straight away.
+func (l *Lease) Follow(journal *Journal, log *Logger) bool {
+    seen := make(map[string]int)
+    leading := ""
+    for {
+        holder, address, expires, ok, err := l.Leader()
+        switch {
+        case err != nil:
+            log.Warn("reading lease", "err", err)
+        case ok && holder == "":
+            if outcome, _ := l.Outcome(); outcome == JobFailed {
+                log.Error("job failed under the leader", "holder", leading)
+            } else {
+                log.Info("job finished by the leader", "holder", leading)
+            }
+            return false
+        case ok && holder != leading:
+            log.Info("following leader", "holder", holder, "address", address, "expires", expires.Format(time.RFC3339))
+            leading = holder
+        }
+        held, err := l.TryAcquire()
+        if err != nil {
+            log.Warn("acquiring lease", "err", err)
+        } else if held {
+            if leading != "" {
+                log.Info("took over from leader", "holder", leading)
+            }
+            return true
+        }
+
+        for _, phase := range []string{"split", "map", "reduce"} {
+            entries, err := journal.Entries(phase)
+            if err != nil {
+                log.Warn("tailing journal", "phase", phase, "err", err)
+                break
+            }
+            if len(entries) != seen[phase] {
+                seen[phase] = len(entries)
+                log.Info("leader progress", "phase", phase, "finished", len(entries))
+            }
+        }
+        time.Sleep(l.interval())
+    }
+}
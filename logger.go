@@ -0,0 +1,160 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// A leveled key/value logger in the style of log/slog. Loggers made with
+// With share their output and level with the logger they came from, so
+// configuring the package logger once in main covers every task.
+
+type Level int
+
+const (
+    LevelDebug Level = -4
+    LevelInfo  Level = 0
+    LevelWarn  Level = 4
+    LevelError Level = 8
+)
+
+func (l Level) String() string {
+    switch l {
+    case LevelDebug:
+        return "DEBUG"
+    case LevelInfo:
+        return "INFO"
+    case LevelWarn:
+        return "WARN"
+    case LevelError:
+        return "ERROR"
+    }
+    return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+func ParseLevel(s string) (Level, error) {
+    switch strings.ToLower(s) {
+    case "debug":
+        return LevelDebug, nil
+    case "info", "":
+        return LevelInfo, nil
+    case "warn", "warning":
+        return LevelWarn, nil
+    case "error":
+        return LevelError, nil
+    }
+    return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+type logOutput struct {
+    mu      sync.Mutex
+    w       io.Writer
+    level   Level
+    json    bool
+}
+
+type Logger struct {
+    out     *logOutput
+    attrs   []interface{}
+}
+
+var logger = NewLogger(os.Stderr, LevelInfo, false)
+
+func NewLogger(w io.Writer, level Level, json bool) *Logger {
+    return &Logger{out: &logOutput{w: w, level: level, json: json}}
+}
+
+// Configure changes where and how l and every logger derived from it write.
+func (l *Logger) Configure(w io.Writer, level Level, json bool) {
+    l.out.mu.Lock()
+    defer l.out.mu.Unlock()
+    l.out.w, l.out.level, l.out.json = w, level, json
+}
+
+// With returns a logger that adds the given key/value pairs to every line.
+func (l *Logger) With(kv ...interface{}) *Logger {
+    attrs := make([]interface{}, 0, len(l.attrs)+len(kv))
+    attrs = append(attrs, l.attrs...)
+    attrs = append(attrs, kv...)
+    return &Logger{out: l.out, attrs: attrs}
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) {l.log(LevelDebug, msg, kv)}
+func (l *Logger) Info(msg string, kv ...interface{}) {l.log(LevelInfo, msg, kv)}
+func (l *Logger) Warn(msg string, kv ...interface{}) {l.log(LevelWarn, msg, kv)}
+func (l *Logger) Error(msg string, kv ...interface{}) {l.log(LevelError, msg, kv)}
+
+func (l *Logger) Enabled(level Level) bool {
+    l.out.mu.Lock()
+    defer l.out.mu.Unlock()
+    return level >= l.out.level
+}
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+    l.out.mu.Lock()
+    defer l.out.mu.Unlock()
+    if level < l.out.level {
+        return
+    }
+    fields := append(append([]interface{}{}, l.attrs...), kv...)
+    if len(fields)%2 == 1 {
+        fields = append(fields[:len(fields)-1], "!BADKEY", fields[len(fields)-1])
+    }
+    var b bytes.Buffer
+    now := time.Now().Format(time.RFC3339Nano)
+    if l.out.json {
+        b.WriteString(`{"time":`)
+        writeJSON(&b, now)
+        b.WriteString(`,"level":`)
+        writeJSON(&b, level.String())
+        b.WriteString(`,"msg":`)
+        writeJSON(&b, msg)
+        for i := 0; i < len(fields); i += 2 {
+            b.WriteByte(',')
+            writeJSON(&b, fmt.Sprint(fields[i]))
+            b.WriteByte(':')
+            writeJSON(&b, logValue(fields[i+1]))
+        }
+        b.WriteString("}\n")
+    } else {
+        fmt.Fprintf(&b, "time=%s level=%s msg=%s", now, level, quoteIfNeeded(msg))
+        for i := 0; i < len(fields); i += 2 {
+            fmt.Fprintf(&b, " %s=%s", fields[i], quoteIfNeeded(fmt.Sprint(logValue(fields[i+1]))))
+        }
+        b.WriteByte('\n')
+    }
+    l.out.w.Write(b.Bytes())
+}
+
+// logValue turns errors and other Stringers into their text so both
+// formats show them the same way.
+func logValue(v interface{}) interface{} {
+    switch v := v.(type) {
+    case error:
+        return v.Error()
+    case fmt.Stringer:
+        return v.String()
+    }
+    return v
+}
+
+func writeJSON(b *bytes.Buffer, v interface{}) {
+    data, err := json.Marshal(v)
+    if err != nil {
+        data, _ = json.Marshal(fmt.Sprint(v))
+    }
+    b.Write(data)
+}
+
+func quoteIfNeeded(s string) string {
+    if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+        return fmt.Sprintf("%q", s)
+    }
+    return s
+}
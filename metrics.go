@@ -0,0 +1,183 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "net/http"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// A small Prometheus text-format exporter. Metrics are process wide, so a
+// worker reports everything it ran no matter which job the tasks were for.
+
+type metric interface {
+    write(w io.Writer)
+}
+
+var registry struct {
+    sync.Mutex
+    metrics []metric
+}
+
+func register(m metric) {
+    registry.Lock()
+    registry.metrics = append(registry.metrics, m)
+    registry.Unlock()
+}
+
+var (
+    metricTasksStarted   = newCounterMetric("mapreduce_tasks_started_total", "Tasks started, by phase.", "phase")
+    metricTasksCompleted = newCounterMetric("mapreduce_tasks_completed_total", "Tasks that finished without error, by phase.", "phase")
+    metricTasksFailed    = newCounterMetric("mapreduce_tasks_failed_total", "Tasks that returned an error, by phase.", "phase")
+    metricRecordsRead    = newCounterMetric("mapreduce_records_read_total", "Input records read by tasks, by phase.", "phase")
+    metricRecordsEmitted = newCounterMetric("mapreduce_records_emitted_total", "Records emitted by user code, by phase.", "phase")
+    metricShuffleBytes   = newCounterMetric("mapreduce_shuffle_bytes_total", "Bytes of map output fetched by reduce tasks.", "")
+    metricInsertSeconds  = newHistogramMetric("mapreduce_sqlite_insert_seconds", "Latency of SQLite inserts of task output.",
+        []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25})
+    metricActiveSlots    = newGaugeMetric("mapreduce_active_task_slots", "Task slots currently running a task.")
+    metricTotalSlots     = newGaugeMetric("mapreduce_task_slots", "Task slots available to this process.")
+)
+
+func formatFloat(v float64) string {return strconv.FormatFloat(v, 'g', -1, 64)}
+
+type counterMetric struct {
+    name, help  string
+    label       string
+    mu          sync.Mutex
+    values      map[string]float64
+}
+
+// newCounterMetric registers a counter with at most one label. An empty
+// label makes a plain counter, updated with an empty label value.
+func newCounterMetric(name, help, label string) *counterMetric {
+    c := &counterMetric{name: name, help: help, label: label, values: make(map[string]float64)}
+    register(c)
+    return c
+}
+
+func (c *counterMetric) Add(labelValue string, v float64) {
+    c.mu.Lock()
+    c.values[labelValue] += v
+    c.mu.Unlock()
+}
+
+func (c *counterMetric) Inc(labelValue string) {c.Add(labelValue, 1)}
+
+func (c *counterMetric) write(w io.Writer) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+    if c.label == "" {
+        fmt.Fprintf(w, "%s %s\n", c.name, formatFloat(c.values[""]))
+        return
+    }
+    var keys []string
+    for k := range c.values {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+        fmt.Fprintf(w, "%s{%s=%q} %s\n", c.name, c.label, k, formatFloat(c.values[k]))
+    }
+}
+
+type gaugeMetric struct {
+    name, help  string
+    mu          sync.Mutex
+    value       float64
+}
+
+func newGaugeMetric(name, help string) *gaugeMetric {
+    g := &gaugeMetric{name: name, help: help}
+    register(g)
+    return g
+}
+
+func (g *gaugeMetric) Add(v float64) {
+    g.mu.Lock()
+    g.value += v
+    g.mu.Unlock()
+}
+
+func (g *gaugeMetric) Set(v float64) {
+    g.mu.Lock()
+    g.value = v
+    g.mu.Unlock()
+}
+
+func (g *gaugeMetric) write(w io.Writer) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(g.value))
+}
+
+type histogramMetric struct {
+    name, help  string
+    buckets     []float64
+    mu          sync.Mutex
+    counts      []uint64
+    sum         float64
+    count       uint64
+}
+
+func newHistogramMetric(name, help string, buckets []float64) *histogramMetric {
+    h := &histogramMetric{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+    register(h)
+    return h
+}
+
+func (h *histogramMetric) Observe(v float64) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    for i, b := range h.buckets {
+        if v <= b {
+            h.counts[i]++
+        }
+    }
+    h.sum += v
+    h.count++
+}
+
+// ObserveSince records the time elapsed since start in seconds.
+func (h *histogramMetric) ObserveSince(start time.Time) {h.Observe(time.Since(start).Seconds())}
+
+func (h *histogramMetric) write(w io.Writer) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+    for i, b := range h.buckets {
+        fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(b), h.counts[i])
+    }
+    fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+    fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", h.name, formatFloat(h.sum), h.name, h.count)
+}
+
+// metricsHandler serves every registered metric in the Prometheus text
+// exposition format.
+func metricsHandler(w http.ResponseWriter, req *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    registry.Lock()
+    metrics := append([]metric(nil), registry.metrics...)
+    registry.Unlock()
+    for _, m := range metrics {
+        m.write(w)
+    }
+}
+
+// trackTask counts a task of phase as started and occupying a slot. The
+// returned func records how it ended.
+func trackTask(phase string) func(err error) {
+    metricTasksStarted.Inc(phase)
+    metricActiveSlots.Add(1)
+    return func(err error) {
+        metricActiveSlots.Add(-1)
+        if err != nil {
+            metricTasksFailed.Inc(phase)
+        } else {
+            metricTasksCompleted.Inc(phase)
+        }
+    }
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+    "sync"
+    "time"
+)
+
+// TaskProgress is how far a running task has got: records processed out of
+// the records in its map split, or key groups reduced out of the distinct
+// keys in its reduce input. Tasks advance it as they go and the coordinator
+// samples it for the CLI and the status page. A nil *TaskProgress ignores
+// updates.
+type TaskProgress struct {
+    mu      sync.Mutex
+    done    int64
+    total   int64
+}
+
+func NewTaskProgress() *TaskProgress {return &TaskProgress{}}
+
+func (p *TaskProgress) AddTotal(n int64) {
+    if p == nil {
+        return
+    }
+    p.mu.Lock()
+    p.total += n
+    p.mu.Unlock()
+}
+
+func (p *TaskProgress) Advance(n int64) {
+    if p == nil {
+        return
+    }
+    p.mu.Lock()
+    p.done += n
+    p.mu.Unlock()
+}
+
+// Reset forgets everything reported so far, for when a task starts over.
+func (p *TaskProgress) Reset() {
+    if p == nil {
+        return
+    }
+    p.mu.Lock()
+    p.done, p.total = 0, 0
+    p.mu.Unlock()
+}
+
+// Fraction is the part of the task done, between 0 and 1.
+func (p *TaskProgress) Fraction() float64 {
+    if p == nil {
+        return 0
+    }
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if p.total <= 0 {
+        return 0
+    }
+    if p.done >= p.total {
+        return 1
+    }
+    return float64(p.done) / float64(p.total)
+}
+
+// estimateRemaining extrapolates the time left from the time spent so far,
+// assuming the rest goes at the same rate. It is zero until there is any
+// progress to go on.
+func estimateRemaining(spent time.Duration, fraction float64) time.Duration {
+    if fraction <= 0 || fraction >= 1 {
+        return 0
+    }
+    return time.Duration(float64(spent) * (1 - fraction) / fraction)
+}
@@ -0,0 +1,569 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "container/heap"
+    "database/sql"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "sort"
+    "strings"
+)
+
+// Formats the map output of a job can be kept in. Final outputs are always
+// SQLite.
+const (
+    FormatSQLite    = "sqlite"
+    FormatRecords   = "records"
+)
+
+// intermediateFile is the name an intermediate file has in format: record
+// files end in .rec instead of .db.
+func intermediateFile(name, format string) string {
+    if format == FormatRecords {
+        return strings.TrimSuffix(name, ".db") + ".rec"
+    }
+    return name
+}
+
+// A record file is a stream of length-prefixed key/value pairs:
+//
+//     magic       "MRREC\x01"
+//     block*      uvarint records, uvarint bytes, then per record
+//                 uvarint len(key), key, uvarint len(value), value
+//     index?      uvarint blocks, then per block
+//                 uvarint offset, uvarint len(first key), first key
+//     footer      uint64 index offset (0 for none), uint64 records,
+//                 uint64 distinct keys, "MRRECEND", all little-endian
+//
+// Pairs are grouped in blocks so a reader can skip to the block a key is in
+// through the index without decoding what comes before it.
+const (
+    recordMagic         = "MRREC\x01"
+    recordFooterMagic   = "MRRECEND"
+    recordFooterSize    = 32
+    recordBlockSize     = 64 << 10
+)
+
+// recordSortBuffer is how many bytes of pairs a sorted RecordWriter holds
+// in memory. Beyond that it sorts them and spills them to a run file next
+// to its own, and Close merges the runs.
+var recordSortBuffer = 16 << 20
+
+type recordIndexEntry struct {
+    offset      int64
+    firstKey    string
+}
+
+// RecordWriter writes a record file. A sorted writer writes its pairs by
+// key, and by value in descending order within a key, which is the order
+// reducers read them in; it can only do so once it has them all, at Close.
+type RecordWriter struct {
+    path        string
+    f           *os.File
+    w           *bufio.Writer
+    sorted      bool
+    indexed     bool
+
+    pending     []Pair
+    buffered    int
+    runs        []string
+
+    block       bytes.Buffer
+    blockCount  int
+    firstKey    string
+    offset      int64
+    index       []recordIndexEntry
+    records     int64
+    keys        int64
+    lastKey     string
+    closed      bool
+}
+
+// CreateRecordFile creates a record file at path, sorted and with an
+// index when asked to.
+func CreateRecordFile(path string, sorted, indexed bool) (*RecordWriter, error) {
+    f, err := os.Create(path)
+    if err != nil {
+        return nil, err
+    }
+    w := &RecordWriter{path: path, f: f, w: bufio.NewWriter(f), sorted: sorted, indexed: indexed}
+    w.w.WriteString(recordMagic)
+    w.offset = int64(len(recordMagic))
+    return w, nil
+}
+
+func (w *RecordWriter) Write(key, value string) error {
+    if !w.sorted {
+        return w.append(key, value)
+    }
+    w.pending = append(w.pending, Pair{Key: key, Value: value})
+    // Count the string headers too, not just the bytes they point at.
+    w.buffered += len(key) + len(value) + 32
+    if w.buffered >= recordSortBuffer {
+        return w.spill()
+    }
+    return nil
+}
+
+// spill writes the pairs held in memory, sorted, to a new run file.
+func (w *RecordWriter) spill() error {
+    run := fmt.Sprintf("%s.run%d", w.path, len(w.runs))
+    rw, err := CreateRecordFile(run, false, false)
+    if err != nil {
+        return err
+    }
+    w.runs = append(w.runs, run)
+    sort.SliceStable(w.pending, func(i, j int) bool {return pairLess(w.pending[i], w.pending[j])})
+    for _, p := range w.pending {
+        if err := rw.append(p.Key, p.Value); err != nil {
+            rw.Close()
+            return err
+        }
+    }
+    w.pending, w.buffered = w.pending[:0], 0
+    return rw.Close()
+}
+
+// writeSorted writes what a sorted writer holds back: from memory when it
+// never spilled, and otherwise by merging its runs.
+func (w *RecordWriter) writeSorted() error {
+    defer func() {
+        for _, run := range w.runs {
+            os.Remove(run)
+        }
+    }()
+    if len(w.runs) == 0 {
+        sort.SliceStable(w.pending, func(i, j int) bool {return pairLess(w.pending[i], w.pending[j])})
+        for _, p := range w.pending {
+            if err := w.append(p.Key, p.Value); err != nil {
+                return err
+            }
+        }
+        w.pending = nil
+        return nil
+    }
+    if len(w.pending) > 0 {
+        if err := w.spill(); err != nil {
+            return err
+        }
+    }
+    w.pending = nil
+    merger, _, err := mergeRecordFiles(w.runs)
+    if err != nil {
+        return err
+    }
+    defer merger.Close()
+    for {
+        p, err := merger.Next()
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        if err := w.append(p.Key, p.Value); err != nil {
+            return err
+        }
+    }
+}
+
+func (w *RecordWriter) append(key, value string) error {
+    if w.blockCount == 0 {
+        w.firstKey = key
+    }
+    if w.records == 0 || key != w.lastKey {
+        w.keys++
+        w.lastKey = key
+    }
+    var n [binary.MaxVarintLen64]byte
+    w.block.Write(n[:binary.PutUvarint(n[:], uint64(len(key)))])
+    w.block.WriteString(key)
+    w.block.Write(n[:binary.PutUvarint(n[:], uint64(len(value)))])
+    w.block.WriteString(value)
+    w.blockCount++
+    w.records++
+    if w.block.Len() >= recordBlockSize {
+        return w.flush()
+    }
+    return nil
+}
+
+func (w *RecordWriter) flush() error {
+    if w.blockCount == 0 {
+        return nil
+    }
+    w.index = append(w.index, recordIndexEntry{offset: w.offset, firstKey: w.firstKey})
+    var n [binary.MaxVarintLen64]byte
+    written := 0
+    for _, v := range []uint64{uint64(w.blockCount), uint64(w.block.Len())} {
+        k, _ := w.w.Write(n[:binary.PutUvarint(n[:], v)])
+        written += k
+    }
+    k, err := w.w.Write(w.block.Bytes())
+    w.offset += int64(written + k)
+    w.block.Reset()
+    w.blockCount = 0
+    return err
+}
+
+// Close writes what is left, the index and the footer. Calling it again
+// does nothing.
+func (w *RecordWriter) Close() error {
+    if w.closed {
+        return nil
+    }
+    w.closed = true
+    defer w.f.Close()
+    if w.sorted {
+        if err := w.writeSorted(); err != nil {
+            return err
+        }
+    }
+    if err := w.flush(); err != nil {
+        return err
+    }
+    var indexOffset int64
+    if w.indexed {
+        indexOffset = w.offset
+        var n [binary.MaxVarintLen64]byte
+        w.w.Write(n[:binary.PutUvarint(n[:], uint64(len(w.index)))])
+        for _, e := range w.index {
+            w.w.Write(n[:binary.PutUvarint(n[:], uint64(e.offset))])
+            w.w.Write(n[:binary.PutUvarint(n[:], uint64(len(e.firstKey)))])
+            w.w.WriteString(e.firstKey)
+        }
+    }
+    var footer [recordFooterSize]byte
+    binary.LittleEndian.PutUint64(footer[0:], uint64(indexOffset))
+    binary.LittleEndian.PutUint64(footer[8:], uint64(w.records))
+    binary.LittleEndian.PutUint64(footer[16:], uint64(w.keys))
+    copy(footer[24:], recordFooterMagic)
+    w.w.Write(footer[:])
+    if err := w.w.Flush(); err != nil {
+        return err
+    }
+    return w.f.Close()
+}
+
+// pairLess orders pairs by key, and pairs with the same key by value in
+// descending order.
+func pairLess(a, b Pair) bool {
+    if a.Key != b.Key {
+        return a.Key < b.Key
+    }
+    return a.Value > b.Value
+}
+
+var errCorruptRecords = errors.New("corrupt record file")
+
+// RecordReader reads the pairs of a record file in the order they were
+// written.
+type RecordReader struct {
+    path        string
+    f           *os.File
+    r           *bufio.Reader
+    end         int64
+    left        uint64
+    index       []recordIndexEntry
+
+    // Records and Keys are how many pairs and distinct keys the file
+    // holds. Keys is only exact for a sorted file.
+    Records     int64
+    Keys        int64
+}
+
+// OpenRecordFile opens the record file at path and reads its footer and
+// index.
+func OpenRecordFile(path string) (*RecordReader, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    r, err := newRecordReader(path, f)
+    if err != nil {
+        f.Close()
+        return nil, err
+    }
+    return r, nil
+}
+
+func newRecordReader(path string, f *os.File) (*RecordReader, error) {
+    info, err := f.Stat()
+    if err != nil {
+        return nil, err
+    }
+    size := info.Size()
+    if size < int64(len(recordMagic))+recordFooterSize {
+        return nil, fmt.Errorf("%s: %w", path, errCorruptRecords)
+    }
+    var footer [recordFooterSize]byte
+    if _, err := f.ReadAt(footer[:], size-recordFooterSize); err != nil {
+        return nil, err
+    }
+    magic := make([]byte, len(recordMagic))
+    if _, err := f.ReadAt(magic, 0); err != nil {
+        return nil, err
+    }
+    if string(footer[24:]) != recordFooterMagic || string(magic) != recordMagic {
+        return nil, fmt.Errorf("%s: %w", path, errCorruptRecords)
+    }
+    r := &RecordReader{
+        path:       path,
+        f:          f,
+        end:        size - recordFooterSize,
+        Records:    int64(binary.LittleEndian.Uint64(footer[8:])),
+        Keys:       int64(binary.LittleEndian.Uint64(footer[16:])),
+    }
+    if indexOffset := int64(binary.LittleEndian.Uint64(footer[0:])); indexOffset > 0 {
+        if indexOffset < int64(len(recordMagic)) || indexOffset > r.end {
+            return nil, r.corrupt(fmt.Errorf("index at %d", indexOffset))
+        }
+        if err := r.readIndex(indexOffset); err != nil {
+            return nil, err
+        }
+        r.end = indexOffset
+    }
+    return r, r.seekOffset(int64(len(recordMagic)))
+}
+
+func (r *RecordReader) readIndex(offset int64) error {
+    br := bufio.NewReader(io.NewSectionReader(r.f, offset, r.end-offset))
+    n, err := binary.ReadUvarint(br)
+    if err != nil {
+        return r.corrupt(err)
+    }
+    for i := uint64(0); i < n; i++ {
+        off, err := binary.ReadUvarint(br)
+        if err != nil {
+            return r.corrupt(err)
+        }
+        key, err := readRecordString(br)
+        if err != nil {
+            return r.corrupt(err)
+        }
+        r.index = append(r.index, recordIndexEntry{offset: int64(off), firstKey: key})
+    }
+    return nil
+}
+
+func (r *RecordReader) seekOffset(offset int64) error {
+    if offset > r.end {
+        return r.corrupt(io.ErrUnexpectedEOF)
+    }
+    r.r = bufio.NewReader(io.NewSectionReader(r.f, offset, r.end-offset))
+    r.left = 0
+    return nil
+}
+
+// Seek moves to the first block that can hold key, so that the next pairs
+// read are the ones at or shortly before it. Without an index that is the
+// start of the file.
+func (r *RecordReader) Seek(key string) error {
+    i := sort.Search(len(r.index), func(i int) bool {return r.index[i].firstKey >= key})
+    // The key's pairs may start in the block before the first one that
+    // begins with it or a later key.
+    if i > 0 {
+        i--
+    }
+    if i >= len(r.index) {
+        return r.seekOffset(int64(len(recordMagic)))
+    }
+    return r.seekOffset(r.index[i].offset)
+}
+
+// Next returns the next pair, or io.EOF after the last one.
+func (r *RecordReader) Next() (Pair, error) {
+    for r.left == 0 {
+        count, err := binary.ReadUvarint(r.r)
+        if err == io.EOF {
+            return Pair{}, io.EOF
+        }
+        if err != nil {
+            return Pair{}, r.corrupt(err)
+        }
+        if _, err := binary.ReadUvarint(r.r); err != nil {
+            return Pair{}, r.corrupt(err)
+        }
+        r.left = count
+    }
+    key, err := readRecordString(r.r)
+    if err != nil {
+        return Pair{}, r.corrupt(err)
+    }
+    value, err := readRecordString(r.r)
+    if err != nil {
+        return Pair{}, r.corrupt(err)
+    }
+    r.left--
+    return Pair{Key: key, Value: value}, nil
+}
+
+func (r *RecordReader) Close() error {return r.f.Close()}
+
+func (r *RecordReader) corrupt(err error) error {
+    if err == io.EOF {
+        err = io.ErrUnexpectedEOF
+    }
+    return fmt.Errorf("%s: %w: %v", r.path, errCorruptRecords, err)
+}
+
+func readRecordString(r *bufio.Reader) (string, error) {
+    n, err := binary.ReadUvarint(r)
+    if err != nil {
+        return "", err
+    }
+    b := make([]byte, n)
+    if _, err := io.ReadFull(r, b); err != nil {
+        return "", err
+    }
+    return string(b), nil
+}
+
+// pairSource is the sorted input of a reduce task.
+type pairSource interface {
+    Next() (Pair, error)
+    Close() error
+}
+
+// rowSource reads pairs from a query over a SQLite reduce input.
+type rowSource struct {
+    rows    *sql.Rows
+}
+
+func (s rowSource) Next() (Pair, error) {
+    if !s.rows.Next() {
+        if err := s.rows.Err(); err != nil {
+            return Pair{}, err
+        }
+        return Pair{}, io.EOF
+    }
+    var p Pair
+    err := s.rows.Scan(&p.Key, &p.Value)
+    return p, err
+}
+
+func (s rowSource) Close() error {return s.rows.Close()}
+
+// recordMerger merges sorted record files into one sorted stream.
+type recordMerger struct {
+    readers []*RecordReader
+    heads   mergeHeap
+}
+
+type mergeHead struct {
+    pair    Pair
+    reader  *RecordReader
+}
+
+type mergeHeap []mergeHead
+
+func (h mergeHeap) Len() int {return len(h)}
+func (h mergeHeap) Less(i, j int) bool {return pairLess(h[i].pair, h[j].pair)}
+func (h mergeHeap) Swap(i, j int) {h[i], h[j] = h[j], h[i]}
+func (h *mergeHeap) Push(x interface{}) {*h = append(*h, x.(mergeHead))}
+func (h *mergeHeap) Pop() interface{} {
+    old := *h
+    x := old[len(old)-1]
+    *h = old[:len(old)-1]
+    return x
+}
+
+// mergeRecordFiles opens every sorted record file in paths for merging. Its
+// Keys is at most the number of distinct keys the merge yields.
+func mergeRecordFiles(paths []string) (*recordMerger, int64, error) {
+    m := &recordMerger{}
+    var keys int64
+    for _, path := range paths {
+        r, err := OpenRecordFile(path)
+        if err != nil {
+            m.Close()
+            return nil, 0, err
+        }
+        m.readers = append(m.readers, r)
+        keys += r.Keys
+        p, err := r.Next()
+        if err == io.EOF {
+            continue
+        }
+        if err != nil {
+            m.Close()
+            return nil, 0, err
+        }
+        m.heads = append(m.heads, mergeHead{pair: p, reader: r})
+    }
+    heap.Init(&m.heads)
+    return m, keys, nil
+}
+
+func (m *recordMerger) Next() (Pair, error) {
+    if len(m.heads) == 0 {
+        return Pair{}, io.EOF
+    }
+    head := m.heads[0]
+    next, err := head.reader.Next()
+    switch {
+    case err == io.EOF:
+        heap.Pop(&m.heads)
+    case err != nil:
+        return Pair{}, err
+    default:
+        m.heads[0].pair = next
+        heap.Fix(&m.heads, 0)
+    }
+    return head.pair, nil
+}
+
+func (m *recordMerger) Close() error {
+    var first error
+    for _, r := range m.readers {
+        if err := r.Close(); err != nil && first == nil {
+            first = err
+        }
+    }
+    return first
+}
+
+// pairWriter is where a map task writes one partition of its output.
+type pairWriter interface {
+    Write(key, value string) error
+    Close() error
+}
+
+// sqlWriter inserts pairs into a SQLite map output.
+type sqlWriter struct {
+    db      *sql.DB
+    stmt    *sql.Stmt
+}
+
+func createSQLWriter(path string) (*sqlWriter, error) {
+    db, err := createDatabase(path)
+    if err != nil {
+        return nil, err
+    }
+    stmt, err := db.Prepare("INSERT INTO pairs VALUES(?, ?)")
+    if err != nil {
+        db.Close()
+        return nil, err
+    }
+    return &sqlWriter{db: db, stmt: stmt}, nil
+}
+
+func (w *sqlWriter) Write(key, value string) error {
+    _, err := w.stmt.Exec(key, value)
+    return err
+}
+
+func (w *sqlWriter) Close() error {
+    if w.db == nil {
+        return nil
+    }
+    w.stmt.Close()
+    err := w.db.Close()
+    w.db = nil
+    return err
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "math/rand"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "testing"
+)
+
+func writeRecords(t *testing.T, path string, sorted, indexed bool, pairs []Pair) *RecordWriter {
+    t.Helper()
+    w, err := CreateRecordFile(path, sorted, indexed)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, p := range pairs {
+        if err := w.Write(p.Key, p.Value); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := w.Close(); err != nil {
+        t.Fatal(err)
+    }
+    return w
+}
+
+func readRecords(t *testing.T, r pairSource) []Pair {
+    t.Helper()
+    var pairs []Pair
+    for {
+        p, err := r.Next()
+        if err == io.EOF {
+            return pairs
+        }
+        if err != nil {
+            t.Fatal(err)
+        }
+        pairs = append(pairs, p)
+    }
+}
+
+// shuffledPairs makes n pairs over keys distinct keys, in random order.
+func shuffledPairs(n, keys int) []Pair {
+    rng := rand.New(rand.NewSource(1))
+    pairs := make([]Pair, n)
+    for i := range pairs {
+        pairs[i] = Pair{Key: fmt.Sprintf("key-%05d", i%keys), Value: fmt.Sprintf("value-%06d", i)}
+    }
+    rng.Shuffle(len(pairs), func(i, j int) {pairs[i], pairs[j] = pairs[j], pairs[i]})
+    return pairs
+}
+
+func sortedCopy(pairs []Pair) []Pair {
+    sorted := append([]Pair(nil), pairs...)
+    sort.SliceStable(sorted, func(i, j int) bool {return pairLess(sorted[i], sorted[j])})
+    return sorted
+}
+
+func samePairs(t *testing.T, got, want []Pair) {
+    t.Helper()
+    if len(got) != len(want) {
+        t.Fatalf("read %d pairs, want %d", len(got), len(want))
+    }
+    for i := range got {
+        if got[i] != want[i] {
+            t.Fatalf("pair %d is %v, want %v", i, got[i], want[i])
+        }
+    }
+}
+
+func TestRecordFileRoundTrip(t *testing.T) {
+    pairs := append(shuffledPairs(5000, 700), Pair{"", ""}, Pair{"tab\tkey", strings.Repeat("long ", 20000)})
+    for _, tt := range []struct {
+        sorted, indexed bool
+    }{{false, false}, {false, true}, {true, false}, {true, true}} {
+        path := filepath.Join(t.TempDir(), "out.rec")
+        writeRecords(t, path, tt.sorted, tt.indexed, pairs)
+        r, err := OpenRecordFile(path)
+        if err != nil {
+            t.Fatal(err)
+        }
+        want := pairs
+        if tt.sorted {
+            want = sortedCopy(pairs)
+            if r.Keys != 702 {
+                t.Errorf("sorted file has %d keys, want 702", r.Keys)
+            }
+        }
+        if r.Records != int64(len(pairs)) {
+            t.Errorf("file has %d records, want %d", r.Records, len(pairs))
+        }
+        if tt.indexed != (len(r.index) > 0) {
+            t.Errorf("indexed %v, but the file has %d index entries", tt.indexed, len(r.index))
+        }
+        samePairs(t, readRecords(t, r), want)
+        r.Close()
+    }
+}
+
+func TestRecordFileSpillsSortedRuns(t *testing.T) {
+    defer func(size int) {recordSortBuffer = size}(recordSortBuffer)
+    recordSortBuffer = 16 << 10
+    dir := t.TempDir()
+    path := filepath.Join(dir, "out.rec")
+    pairs := shuffledPairs(20000, 3000)
+    w := writeRecords(t, path, true, false, pairs)
+    if len(w.runs) < 10 {
+        t.Errorf("spilled %d runs, want at least 10", len(w.runs))
+    }
+    for _, run := range w.runs {
+        if _, err := os.Stat(run); !os.IsNotExist(err) {
+            t.Errorf("run %s left behind", run)
+        }
+    }
+    r, err := OpenRecordFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer r.Close()
+    if r.Keys != 3000 {
+        t.Errorf("file has %d keys, want 3000", r.Keys)
+    }
+    samePairs(t, readRecords(t, r), sortedCopy(pairs))
+}
+
+func TestMergeRecordFiles(t *testing.T) {
+    dir := t.TempDir()
+    pairs := shuffledPairs(9000, 500)
+    var paths []string
+    for i := 0; i < 3; i++ {
+        path := filepath.Join(dir, fmt.Sprintf("map_%d.rec", i))
+        writeRecords(t, path, true, false, pairs[i*3000:(i+1)*3000])
+        paths = append(paths, path)
+    }
+    empty := filepath.Join(dir, "empty.rec")
+    writeRecords(t, empty, true, false, nil)
+    merger, keys, err := mergeRecordFiles(append(paths, empty))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer merger.Close()
+    if keys < 500 || keys > 1500 {
+        t.Errorf("merge estimates %d keys, want between 500 and 1500", keys)
+    }
+    samePairs(t, readRecords(t, merger), sortedCopy(pairs))
+}
+
+func TestRecordFileSeek(t *testing.T) {
+    dir := t.TempDir()
+    pairs := shuffledPairs(40000, 40000)
+    indexed, plain := filepath.Join(dir, "indexed.rec"), filepath.Join(dir, "plain.rec")
+    writeRecords(t, indexed, true, true, pairs)
+    writeRecords(t, plain, true, false, pairs)
+    for _, tt := range []struct {
+        path        string
+        key         string
+        maxSkipped  int
+    }{
+        {indexed, "key-31234", recordBlockSize / 20},
+        {indexed, "key-00000", 0},
+        {indexed, "key-31234x", recordBlockSize / 20},
+        {indexed, "zzz", recordBlockSize / 20},
+        {plain, "key-31234", 31234},
+    } {
+        r, err := OpenRecordFile(tt.path)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if err := r.Seek(tt.key); err != nil {
+            t.Fatal(err)
+        }
+        skipped := 0
+        for {
+            p, err := r.Next()
+            if err == io.EOF {
+                break
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if p.Key >= tt.key {
+                break
+            }
+            skipped++
+        }
+        if skipped > tt.maxSkipped || tt.path == plain && skipped != tt.maxSkipped {
+            t.Errorf("%s: seeking %q left %d pairs before it, want at most %d", filepath.Base(tt.path), tt.key, skipped, tt.maxSkipped)
+        }
+        r.Close()
+    }
+}
+
+func TestRecordFileCorrupt(t *testing.T) {
+    dir := t.TempDir()
+    path := filepath.Join(dir, "good.rec")
+    writeRecords(t, path, true, true, shuffledPairs(20000, 100))
+    good, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    footer := len(good) - recordFooterSize
+    for _, tt := range []struct {
+        name    string
+        damage  func([]byte) []byte
+    }{
+        {"truncated footer", func(b []byte) []byte {return b[:len(b)-5]}},
+        {"no footer", func(b []byte) []byte {return b[:footer]}},
+        {"too short", func(b []byte) []byte {return b[:10]}},
+        {"bad footer magic", func(b []byte) []byte {b[len(b)-1] = 'X'; return b}},
+        {"bad magic", func(b []byte) []byte {b[0] = 'X'; return b}},
+        {"index past the end", func(b []byte) []byte {b[footer+3] = 0xff; return b}},
+    } {
+        damaged := filepath.Join(dir, "damaged.rec")
+        if err := os.WriteFile(damaged, tt.damage(append([]byte(nil), good...)), 0644); err != nil {
+            t.Fatal(err)
+        }
+        r, err := OpenRecordFile(damaged)
+        if err == nil {
+            for err == nil {
+                _, err = r.Next()
+            }
+            r.Close()
+            if err == io.EOF {
+                t.Errorf("%s: read to the end without an error", tt.name)
+                continue
+            }
+        }
+        if !errors.Is(err, errCorruptRecords) {
+            t.Errorf("%s: %v, want a corrupt record file", tt.name, err)
+        }
+    }
+
+    // Blocks cut short show up while reading rather than on opening.
+    plain := filepath.Join(dir, "plain.rec")
+    writeRecords(t, plain, true, false, shuffledPairs(20000, 100))
+    data, err := os.ReadFile(plain)
+    if err != nil {
+        t.Fatal(err)
+    }
+    data = append(data[:len(recordMagic)+1000], data[len(data)-recordFooterSize:]...)
+    if err := os.WriteFile(plain, data, 0644); err != nil {
+        t.Fatal(err)
+    }
+    r, err := OpenRecordFile(plain)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer r.Close()
+    for err == nil {
+        _, err = r.Next()
+    }
+    if !errors.Is(err, errCorruptRecords) || !strings.Contains(err.Error(), "unexpected EOF") {
+        t.Errorf("reading a truncated block: %v, want a corrupt record file", err)
+    }
+}
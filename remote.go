@@ -0,0 +1,214 @@
+package main
+
+import (
+    "bytes"
+    "crypto/tls"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// RemoteAttempt is one attempt of a map or reduce task that the coordinator
+// has a worker process run (see -worker). Workers share the coordinator's
+// data directory, on one machine or a shared filesystem: an attempt writes
+// its output straight into the directory the coordinator gave it, and the
+// coordinator commits it from there. What a task reads it fetches over
+// HTTP from the coordinator, like any other task.
+type RemoteAttempt struct {
+    Map         *MapTask        `json:"map,omitempty"`
+    Reduce      *ReduceTask     `json:"reduce,omitempty"`
+
+    // Join is the job's reducer when it joins its inputs; a job without one
+    // runs Client.
+    Join        *JoinReducer    `json:"join,omitempty"`
+
+    // Codec names the task's codec. DirectReads has the task read the
+    // worker's data directory instead of fetching from the coordinator.
+    Codec       string          `json:"codec,omitempty"`
+    DirectReads bool            `json:"direct_reads,omitempty"`
+
+    // URLKey is the key the job's URLs are signed with, if it signs them.
+    URLKey      []byte          `json:"url_key,omitempty"`
+}
+
+// RemoteResult is how an attempt went on a worker: the counters it ended
+// with and its error, if any. An attempt that could not get a good copy of
+// a map task's output says which, and whether the output was missing or
+// corrupt, so the coordinator can have it made again.
+type RemoteResult struct {
+    Counters    map[string]int64    `json:"counters"`
+    Err         string              `json:"err,omitempty"`
+    LostMap     *int                `json:"lost_map,omitempty"`
+    Missing     bool                `json:"missing,omitempty"`
+    Corrupt     *ChecksumError      `json:"corrupt,omitempty"`
+}
+
+// remoteError is an error that came back from a worker, which still says
+// whether a file was missing.
+type remoteError struct {
+    msg         string
+    missing     bool
+}
+
+func (e *remoteError) Error() string {return e.msg}
+
+func (e *remoteError) Is(target error) bool {return e.missing && target == os.ErrNotExist}
+
+func newRemoteResult(counters *Counters, err error) RemoteResult {
+    result := RemoteResult{Counters: counters.Snapshot()}
+    if err == nil {
+        return result
+    }
+    result.Err = err.Error()
+    var lost *MapOutputError
+    if errors.As(err, &lost) {
+        result.LostMap, result.Err = &lost.Map, lost.Err.Error()
+    }
+    result.Missing = errors.Is(err, os.ErrNotExist)
+    errors.As(err, &result.Corrupt)
+    return result
+}
+
+// err rebuilds the attempt's error, nil when it succeeded.
+func (r RemoteResult) err() error {
+    if r.Err == "" {
+        return nil
+    }
+    var err error = &remoteError{msg: r.Err, missing: r.Missing}
+    if r.Corrupt != nil {
+        err = r.Corrupt
+    }
+    if r.LostMap != nil {
+        err = &MapOutputError{Map: *r.LostMap, Err: err}
+    }
+    return err
+}
+
+// runRemote has the worker process at worker run an attempt of job, and
+// adds the counters it ends with to the attempt's.
+func (job *Job) runRemote(worker string, a RemoteAttempt, h attemptHandles) error {
+    switch client := job.Client.(type) {
+    case JoinReducer:
+        a.Join = &client
+    case Client:
+    default:
+        return fmt.Errorf("a %T cannot run on worker %s", job.Client, worker)
+    }
+    if job.Codec != nil {
+        a.Codec = job.Codec.Name()
+    }
+    a.DirectReads = job.DirectReads
+    a.URLKey = jobURLKey(job.ID)
+    body, err := json.Marshal(a)
+    if err != nil {
+        return err
+    }
+    resp, err := shuffleClient().Post(fmt.Sprintf("%s://%s/attempts", shuffleScheme(), worker), "application/json", bytes.NewReader(body))
+    if err != nil {
+        return fmt.Errorf("running attempt on worker %s: %v", worker, err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+        return fmt.Errorf("running attempt on worker %s: %s: %s", worker, resp.Status, strings.TrimSpace(string(msg)))
+    }
+    var result RemoteResult
+    if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+        return fmt.Errorf("running attempt on worker %s: %v", worker, err)
+    }
+    for name, v := range result.Counters {
+        h.counters.Increment(name, v)
+    }
+    return result.err()
+}
+
+// attemptHandler runs the attempts coordinators send to a worker process.
+// Their output has to go to dir, the data directory the worker shares
+// with them.
+func attemptHandler(dir, host string) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        var a RemoteAttempt
+        if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        result, err := a.run(dir, host)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(result)
+    })
+}
+
+// run runs the attempt in the worker's data directory dir. It fails only
+// when the attempt cannot be run at all; how the attempt itself went is in
+// the result.
+func (a *RemoteAttempt) run(dir, host string) (RemoteResult, error) {
+    codec, err := CodecByName(a.Codec)
+    if err != nil {
+        return RemoteResult{}, err
+    }
+    var client Interface = Client{}
+    if a.Join != nil {
+        client = *a.Join
+    }
+    var store Storage
+    if a.DirectReads {
+        store = &LocalStorage{Dir: dir, Host: host}
+    }
+    counters := NewCounters()
+    switch {
+    case a.Map != nil && inDir(dir, a.Map.OutputDir):
+        useJobURLKey(a.Map.JobID, a.URLKey)
+        a.Map.Counters, a.Map.Progress, a.Map.Store, a.Map.Codec = counters, NewTaskProgress(), store, codec
+        err = a.Map.Process(dir, client)
+    case a.Reduce != nil && inDir(dir, a.Reduce.OutputDir):
+        useJobURLKey(a.Reduce.JobID, a.URLKey)
+        a.Reduce.Counters, a.Reduce.Progress, a.Reduce.Store, a.Reduce.Codec = counters, NewTaskProgress(), store, codec
+        err = a.Reduce.Process(dir, client)
+    default:
+        return RemoteResult{}, fmt.Errorf("no task with an output directory under %s", dir)
+    }
+    return newRemoteResult(counters, err), nil
+}
+
+// inDir reports whether path lies within dir.
+func inDir(dir, path string) bool {
+    rel, err := filepath.Rel(dir, path)
+    return err == nil && filepath.IsAbs(path) && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// serveWorker runs this process as a worker on address until it is
+// killed, running the attempts coordinators send it with dir as its data
+// directory. With tlsConfig set it serves over TLS.
+func serveWorker(address, dir string, tlsConfig *tls.Config) error {
+    dir, err := filepath.Abs(dir)
+    if err != nil {
+        return err
+    }
+    listener, err := net.Listen("tcp", address)
+    if err != nil {
+        return err
+    }
+    mux := http.NewServeMux()
+    mux.Handle("/attempts", attemptHandler(dir, address))
+    mux.HandleFunc("/metrics", metricsHandler)
+    server := &http.Server{Handler: mux, TLSConfig: tlsConfig}
+    logger.Info("worker ready", "address", address, "dir", dir)
+    if tlsConfig != nil {
+        return server.ServeTLS(listener, "", "")
+    }
+    return server.Serve(listener)
+}
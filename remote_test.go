@@ -0,0 +1,86 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "strings"
+    "testing"
+)
+
+// throughJSON sends the result of an attempt that ended with err the way a
+// worker does, and returns the error the coordinator rebuilds from it.
+func throughJSON(t *testing.T, err error) error {
+    t.Helper()
+    counters := NewCounters()
+    counters.Increment(CounterShuffleBytes, 42)
+    data, jerr := json.Marshal(newRemoteResult(counters, err))
+    if jerr != nil {
+        t.Fatal(jerr)
+    }
+    var result RemoteResult
+    if jerr := json.Unmarshal(data, &result); jerr != nil {
+        t.Fatal(jerr)
+    }
+    if result.Counters[CounterShuffleBytes] != 42 {
+        t.Errorf("counters = %v, want %s=42", result.Counters, CounterShuffleBytes)
+    }
+    return result.err()
+}
+
+func TestRemoteResultKeepsErrors(t *testing.T) {
+    if err := throughJSON(t, nil); err != nil {
+        t.Errorf("success came back as %v", err)
+    }
+    if err := throughJSON(t, fmt.Errorf("mapper panicked")); err == nil || err.Error() != "mapper panicked" {
+        t.Errorf("error came back as %v", err)
+    }
+
+    missing := &MapOutputError{Map: 3, Err: &os.PathError{Op: "fetch", Path: "job_map_3_output_0.db", Err: os.ErrNotExist}}
+    err := throughJSON(t, missing)
+    var lost *MapOutputError
+    if !errors.As(err, &lost) || lost.Map != 3 || !errors.Is(err, os.ErrNotExist) {
+        t.Errorf("missing map output came back as %#v", err)
+    }
+    if err.Error() != missing.Error() {
+        t.Errorf("error %q came back as %q", missing, err)
+    }
+
+    corrupt := &MapOutputError{Map: 5, Err: &ChecksumError{Name: "job_map_5_output_1.db", Want: "sha256:aa", Got: "sha256:bb"}}
+    err = throughJSON(t, corrupt)
+    var checksum *ChecksumError
+    if !errors.As(err, &lost) || lost.Map != 5 || !errors.As(err, &checksum) || *checksum != *corrupt.Err.(*ChecksumError) {
+        t.Errorf("corrupt map output came back as %#v", err)
+    }
+    if errors.Is(err, os.ErrNotExist) {
+        t.Errorf("corrupt map output came back as missing")
+    }
+}
+
+func TestAttemptHandlerKeepsOutputInDataDir(t *testing.T) {
+    dir := t.TempDir()
+    srv := httptest.NewServer(attemptHandler(dir, "worker"))
+    defer srv.Close()
+    for _, outdir := range []string{"", "relative", dir + "/../elsewhere", "/etc"} {
+        body, _ := json.Marshal(RemoteAttempt{Map: &MapTask{JobID: "job", R: 1, OutputDir: outdir}})
+        resp, err := http.Post(srv.URL, "application/json", strings.NewReader(string(body)))
+        if err != nil {
+            t.Fatal(err)
+        }
+        resp.Body.Close()
+        if resp.StatusCode != http.StatusBadRequest {
+            t.Errorf("output dir %q: status %d, want %d", outdir, resp.StatusCode, http.StatusBadRequest)
+        }
+    }
+    resp, err := http.Get(srv.URL)
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusMethodNotAllowed {
+        t.Errorf("GET: status %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+    }
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// JobReport is the machine-readable record of a finished job, written as
+// JSON next to its output so runs can be compared over time.
+type JobReport struct {
+    Config      JobConfig           `json:"config"`
+    Started     time.Time           `json:"started"`
+    Finished    time.Time           `json:"finished"`
+    Seconds     float64             `json:"seconds"`
+    Reason      string              `json:"reason,omitempty"`
+    Blacklisted map[string]string   `json:"blacklisted,omitempty"`
+    Tasks       []TaskReport        `json:"tasks"`
+    Partitions  []PartitionReport   `json:"partitions"`
+    Failures    int                 `json:"failures"`
+    Retries     int                 `json:"retries"`
+    Counters    map[string]int64    `json:"counters"`
+}
+
+type JobConfig struct {
+    ID          string      `json:"id"`
+    M           int         `json:"m"`
+    R           int         `json:"r"`
+    Source      string      `json:"source"`
+    Output      string      `json:"output"`
+    CacheFiles  []string    `json:"cache_files,omitempty"`
+}
+
+type TaskReport struct {
+    Phase           string      `json:"phase"`
+    N               int         `json:"n"`
+    Host            string      `json:"host"`
+    State           TaskState   `json:"state"`
+    Started         time.Time   `json:"started"`
+    Finished        time.Time   `json:"finished"`
+    Seconds         float64     `json:"seconds"`
+    InputRecords    int64       `json:"input_records"`
+    OutputRecords   int64       `json:"output_records"`
+    Attempts        int         `json:"attempts"`
+    Speculative     int         `json:"speculative"`
+    Resumed         bool        `json:"resumed,omitempty"`
+    Failures        int         `json:"failures"`
+    Error           string      `json:"error,omitempty"`
+}
+
+// PartitionReport is how much of the map output landed on one reducer.
+type PartitionReport struct {
+    Reducer     int     `json:"reducer"`
+    Records     int64   `json:"records"`
+    Keys        int64   `json:"keys"`
+    Bytes       int64   `json:"bytes"`
+}
+
+// Report summarizes the job as it stands now.
+func (s *JobStatus) Report() JobReport {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    finished := s.Finished
+    if finished.IsZero() {
+        finished = time.Now()
+    }
+    report := JobReport{
+        Config:     JobConfig{ID: s.ID, M: s.M, R: s.R, Source: s.Source, Output: s.Output, CacheFiles: s.CacheFiles},
+        Started:    s.Started,
+        Finished:   finished,
+        Seconds:    finished.Sub(s.Started).Seconds(),
+        Reason:     s.Reason,
+    }
+    if len(s.Blacklisted) > 0 {
+        report.Blacklisted = make(map[string]string)
+        for worker, reason := range s.Blacklisted {
+            report.Blacklisted[worker] = reason
+        }
+    }
+    total := NewCounters()
+    for _, t := range s.tasks {
+        total.Merge(t.counters)
+        tr := TaskReport{
+            Phase: t.Phase, N: t.N, Host: t.Host, State: t.State,
+            Started: t.Started, Finished: t.Finished,
+            Attempts: t.Attempts, Speculative: t.Speculative, Resumed: t.Resumed, Failures: t.Failures, Error: t.Err,
+        }
+        if !t.Finished.IsZero() {
+            tr.Seconds = t.Finished.Sub(t.Started).Seconds()
+        }
+        switch t.Phase {
+        case "map":
+            tr.InputRecords = t.counters.Get(CounterMapInputRecords)
+            tr.OutputRecords = t.counters.Get(CounterMapOutputRecords)
+        case "reduce":
+            tr.InputRecords = t.counters.Get(CounterReduceInputRecords)
+            tr.OutputRecords = t.counters.Get(CounterReduceOutputRecords)
+            report.Partitions = append(report.Partitions, PartitionReport{
+                Reducer:    t.N,
+                Records:    tr.InputRecords,
+                Keys:       t.counters.Get(CounterReduceInputGroups),
+                Bytes:      t.counters.Get(CounterShuffleBytes),
+            })
+        }
+        report.Tasks = append(report.Tasks, tr)
+        report.Failures += t.Failures
+        if t.Attempts > 1 {
+            report.Retries += t.Attempts - 1
+        }
+    }
+    report.Counters = total.Snapshot()
+    return report
+}
+
+// reportFile is where the report for a job writing output goes, e.g.
+// result.json for result.db.
+func reportFile(output string) string {
+    return strings.TrimSuffix(output, ".db") + ".json"
+}
+
+// historyFile names a report in the history directory by its start time so
+// a listing sorts in run order.
+func historyFile(report JobReport) string {
+    return fmt.Sprintf("job_%s.json", report.Started.Format("20060102_150405.000"))
+}
+
+// WriteReport writes the report next to the job output, wherever that is
+// stored, and, when historyDir is set, a copy into historyDir.
+func WriteReport(report JobReport, historyDir string) error {
+    data, err := json.MarshalIndent(report, "", "  ")
+    if err != nil {
+        return err
+    }
+    data = append(data, '\n')
+    store, name, err := openLocation(report.Config.Output)
+    if err != nil {
+        return err
+    }
+    w, err := store.Create(reportFile(name))
+    if err == nil {
+        if _, err = w.Write(data); err == nil {
+            err = w.Close()
+        } else {
+            w.Close()
+        }
+    }
+    if err != nil {
+        return fmt.Errorf("writing job report: %v", err)
+    }
+    if historyDir == "" {
+        return nil
+    }
+    if err := os.MkdirAll(historyDir, 0755); err != nil {
+        return fmt.Errorf("creating history directory: %v", err)
+    }
+    if err := os.WriteFile(filepath.Join(historyDir, historyFile(report)), data, 0644); err != nil {
+        return fmt.Errorf("writing job history: %v", err)
+    }
+    return nil
+}
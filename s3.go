@@ -0,0 +1,296 @@
+package main
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/xml"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+)
+
+// S3Storage keeps files as objects in a bucket of an S3-compatible object
+// store, under Prefix. Requests use path-style addressing
+// (Endpoint/Bucket/key), which MinIO and most stand-ins expect, and are
+// signed with AWS Signature Version 4.
+type S3Storage struct {
+    Endpoint    string
+    Region      string
+    Bucket      string
+    Prefix      string
+    AccessKey   string
+    SecretKey   string
+    Client      *http.Client
+}
+
+// NewS3Storage returns the store for bucket at the endpoint and with the
+// credentials in the environment: AWS_ENDPOINT_URL (AWS itself when unset),
+// AWS_REGION, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+func NewS3Storage(bucket, prefix string) *S3Storage {
+    s := &S3Storage{
+        Endpoint:   os.Getenv("AWS_ENDPOINT_URL"),
+        Region:     os.Getenv("AWS_REGION"),
+        Bucket:     bucket,
+        Prefix:     prefix,
+        AccessKey:  os.Getenv("AWS_ACCESS_KEY_ID"),
+        SecretKey:  os.Getenv("AWS_SECRET_ACCESS_KEY"),
+    }
+    if s.Region == "" {
+        s.Region = "us-east-1"
+    }
+    if s.Endpoint == "" {
+        s.Endpoint = "https://s3." + s.Region + ".amazonaws.com"
+    }
+    return s
+}
+
+func (s *S3Storage) client() *http.Client {
+    if s.Client != nil {
+        return s.Client
+    }
+    return http.DefaultClient
+}
+
+func (s *S3Storage) key(name string) string {return s.Prefix + name}
+
+// s3Error is the body of a failed S3 request.
+type s3Error struct {
+    Code    string
+    Message string
+}
+
+// do sends a signed request for key, or for the bucket itself when key is
+// empty, and returns the response if its status is 2xx.
+func (s *S3Storage) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+    u, err := url.Parse(strings.TrimRight(s.Endpoint, "/"))
+    if err != nil {
+        return nil, err
+    }
+    u.Path += "/" + s.Bucket
+    if key != "" {
+        u.Path += "/" + key
+    }
+    u.RawPath = s3Escape(u.Path)
+    u.RawQuery = s3Query(query)
+    req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+    if err != nil {
+        return nil, err
+    }
+    for k, v := range header {
+        req.Header[k] = v
+    }
+    s.sign(req, body, time.Now().UTC())
+    resp, err := s.client().Do(req)
+    if err != nil {
+        return nil, err
+    }
+    if resp.StatusCode/100 == 2 {
+        return resp, nil
+    }
+    defer resp.Body.Close()
+    var e s3Error
+    xml.NewDecoder(resp.Body).Decode(&e)
+    if resp.StatusCode == http.StatusNotFound {
+        return nil, &os.PathError{Op: strings.ToLower(method), Path: s.URL(strings.TrimPrefix(key, s.Prefix)), Err: os.ErrNotExist}
+    }
+    return nil, fmt.Errorf("s3 %s %s: %s %s: %s", method, u.Path, resp.Status, e.Code, e.Message)
+}
+
+func (s *S3Storage) Open(name string) (io.ReadCloser, error) {
+    resp, err := s.do("GET", s.key(name), nil, nil, nil)
+    if err != nil {
+        return nil, err
+    }
+    return resp.Body, nil
+}
+
+// s3Object buffers a file being created and uploads it in one PUT when it
+// is closed, so the object appears whole or not at all.
+type s3Object struct {
+    bytes.Buffer
+    store   *S3Storage
+    name    string
+}
+
+func (o *s3Object) Close() error {
+    resp, err := o.store.do("PUT", o.store.key(o.name), nil, nil, o.Bytes())
+    if err != nil {
+        return err
+    }
+    return resp.Body.Close()
+}
+
+func (s *S3Storage) Create(name string) (io.WriteCloser, error) {
+    return &s3Object{store: s, name: name}, nil
+}
+
+type s3ListResult struct {
+    Contents                []struct{ Key string }
+    IsTruncated             bool
+    NextContinuationToken   string
+}
+
+func (s *S3Storage) List(prefix string) ([]string, error) {
+    var names []string
+    query := url.Values{"list-type": {"2"}, "prefix": {s.key(prefix)}}
+    for {
+        resp, err := s.do("GET", "", query, nil, nil)
+        if err != nil {
+            return names, err
+        }
+        var result s3ListResult
+        err = xml.NewDecoder(resp.Body).Decode(&result)
+        resp.Body.Close()
+        if err != nil {
+            return names, fmt.Errorf("s3 listing %s: %v", s.key(prefix), err)
+        }
+        for _, c := range result.Contents {
+            names = append(names, strings.TrimPrefix(c.Key, s.Prefix))
+        }
+        if !result.IsTruncated || result.NextContinuationToken == "" {
+            return names, nil
+        }
+        query.Set("continuation-token", result.NextContinuationToken)
+    }
+}
+
+func (s *S3Storage) Remove(name string) error {
+    resp, err := s.do("DELETE", s.key(name), nil, nil, nil)
+    if err != nil {
+        return err
+    }
+    return resp.Body.Close()
+}
+
+// Rename copies the object server-side and deletes the original. Unlike a
+// local rename it is not atomic, but the copy is: readers see either no
+// object under the new name or all of it.
+func (s *S3Storage) Rename(from, to string) error {
+    header := http.Header{"X-Amz-Copy-Source": {s3Escape("/" + s.Bucket + "/" + s.key(from))}}
+    resp, err := s.do("PUT", s.key(to), nil, header, nil)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    return s.Remove(from)
+}
+
+func (s *S3Storage) URL(name string) string {return "s3://" + s.Bucket + "/" + s.key(name)}
+
+// sign adds the AWS Signature Version 4 headers to req.
+func (s *S3Storage) sign(req *http.Request, body []byte, now time.Time) {
+    payload := sha256.Sum256(body)
+    payloadHash := hex.EncodeToString(payload[:])
+    amzDate := now.Format("20060102T150405Z")
+    date := now.Format("20060102")
+    req.Header.Set("X-Amz-Date", amzDate)
+    req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+    headers := map[string]string{"host": req.URL.Host}
+    for k, v := range req.Header {
+        if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-amz-") || lk == "content-type" {
+            headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+        }
+    }
+    var names []string
+    for k := range headers {
+        names = append(names, k)
+    }
+    sort.Strings(names)
+    var canonicalHeaders strings.Builder
+    for _, k := range names {
+        canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+    }
+    signedHeaders := strings.Join(names, ";")
+
+    canonical := strings.Join([]string{
+        req.Method,
+        req.URL.EscapedPath(),
+        req.URL.RawQuery,
+        canonicalHeaders.String(),
+        signedHeaders,
+        payloadHash,
+    }, "\n")
+    scope := date + "/" + s.Region + "/s3/aws4_request"
+    hashed := sha256.Sum256([]byte(canonical))
+    toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+    key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+    key = hmacSHA256(key, s.Region)
+    key = hmacSHA256(key, "s3")
+    key = hmacSHA256(key, "aws4_request")
+    signature := hex.EncodeToString(hmacSHA256(key, toSign))
+    req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+        s.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+    h := hmac.New(sha256.New, key)
+    h.Write([]byte(data))
+    return h.Sum(nil)
+}
+
+// s3Escape percent-encodes a path the way SigV4 expects: everything but
+// unreserved characters and the slashes between segments.
+func s3Escape(path string) string {
+    var b strings.Builder
+    for i := 0; i < len(path); i++ {
+        c := path[i]
+        if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+            b.WriteByte(c)
+        } else {
+            fmt.Fprintf(&b, "%%%02X", c)
+        }
+    }
+    return b.String()
+}
+
+// s3Query encodes a query string in the sorted, fully escaped form that is
+// both sent and signed.
+func s3Query(query url.Values) string {
+    var keys []string
+    for k := range query {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    var parts []string
+    for _, k := range keys {
+        for _, v := range query[k] {
+            parts = append(parts, strings.ReplaceAll(s3Escape(k), "/", "%2F")+"="+strings.ReplaceAll(s3Escape(v), "/", "%2F"))
+        }
+    }
+    return strings.Join(parts, "&")
+}
+
+// openLocation splits where a job reads its input or writes its output into
+// a Storage and the name of the file in it. s3://bucket/key names an object;
+// anything else is a path on local disk.
+func openLocation(location string) (Storage, string, error) {
+    if strings.HasPrefix(location, "s3://") {
+        bucket, key := location[len("s3://"):], ""
+        if i := strings.IndexByte(bucket, '/'); i >= 0 {
+            bucket, key = bucket[:i], bucket[i+1:]
+        }
+        if bucket == "" || key == "" {
+            return nil, "", fmt.Errorf("%s: want s3://bucket/key", location)
+        }
+        prefix, name := "", key
+        if i := strings.LastIndexByte(key, '/'); i >= 0 {
+            prefix, name = key[:i+1], key[i+1:]
+        }
+        return NewS3Storage(bucket, prefix), name, nil
+    }
+    dir, name := filepath.Split(location)
+    if dir == "" {
+        dir = "."
+    }
+    return &LocalStorage{Dir: dir}, name, nil
+}
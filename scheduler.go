@@ -0,0 +1,363 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "time"
+)
+
+// Phase is one map or reduce phase as the scheduler sees it: N tasks, each
+// run as one or more attempts numbered from 1.
+type Phase struct {
+    Name    string
+    N       int
+
+    // Run runs one attempt of task n on worker and returns when it is
+    // finished.
+    Run     func(n, attempt int, worker string) error
+
+    // Commit makes a successful attempt's output the output of its task.
+    // It is called once per task, for the first attempt to succeed.
+    Commit  func(n, attempt int) error
+
+    // Discard throws away the output of an attempt that failed or lost,
+    // once it has stopped running.
+    Discard func(n, attempt int)
+
+    // Status, when set, holds the status page entry of every task.
+    Status  []*TaskStatus
+
+    // Completed marks tasks that an earlier run of the job already
+    // finished. They are not run again.
+    Completed map[int]bool
+
+    // MaxFailedPercent is how many of the phase's tasks, as a percentage,
+    // may run out of attempts without failing the phase. At 0 the first
+    // such task fails it straight away.
+    MaxFailedPercent float64
+
+    // Failed is filled in by RunPhase with the tasks that ran out of
+    // attempts but were tolerated.
+    Failed  map[int]bool
+}
+
+// Scheduler runs the tasks of a phase on Slots slots of each of its
+// workers. A failed attempt is retried after a backoff that doubles each
+// time, preferably on another worker, until the task has failed
+// MaxAttempts times. A worker whose attempts fail MaxWorkerFailures times
+// over the job is blacklisted and given no more, unless it is the last
+// one left.
+//
+// With Speculative set, once every task of a phase has started and a slot
+// is free, it launches a backup attempt of any task that has been running
+// for more than SlowTaskFactor times the median time of the tasks already
+// done, and for at least MinSlowTaskTime. The backup runs on another
+// worker than the attempt it backs up where one has a free slot, and on a
+// free slot of the same worker otherwise. Whichever attempt finishes first
+// is committed and the other discarded.
+type Scheduler struct {
+    Slots               int
+    Workers             []string
+    Speculative         bool
+    SlowTaskFactor      float64
+    MinSlowTaskTime     time.Duration
+    CheckInterval       time.Duration
+    MaxAttempts         int
+    Backoff             time.Duration
+    MaxBackoff          time.Duration
+    MaxWorkerFailures   int
+    Log                 *Logger
+
+    // Status, when set, is told about blacklisted workers.
+    Status              *JobStatus
+
+    workerFailures      map[string]int
+    blacklisted         map[string]bool
+}
+
+func NewScheduler(slots int, log *Logger) *Scheduler {
+    return &Scheduler{
+        Slots:              slots,
+        Workers:            []string{"local"},
+        SlowTaskFactor:     1.5,
+        MinSlowTaskTime:    10 * time.Second,
+        CheckInterval:      500 * time.Millisecond,
+        MaxAttempts:        4,
+        Backoff:            time.Second,
+        MaxBackoff:         30 * time.Second,
+        MaxWorkerFailures:  3,
+        Log:                log,
+    }
+}
+
+type attemptResult struct {
+    n, attempt  int
+    worker      string
+    err         error
+}
+
+type phaseTask struct {
+    n           int
+    attempts    int
+    failures    int
+    running     map[int]time.Time
+    runningOn   map[int]string
+    failedOn    map[string]bool
+    retryAt     time.Time
+    done        bool
+    resumed     bool
+    took        time.Duration
+}
+
+// RunPhase runs every task of p to completion. It returns an error as soon
+// as a task runs out of attempts, unless p.MaxFailedPercent tolerates it.
+func (s *Scheduler) RunPhase(p *Phase) error {
+    tasks := make([]*phaseTask, p.N)
+    for n := range tasks {
+        tasks[n] = &phaseTask{n: n, running: make(map[int]time.Time), runningOn: make(map[int]string), failedOn: make(map[string]bool)}
+    }
+    p.Failed = make(map[int]bool)
+    results := make(chan attemptResult)
+    running, finished := 0, 0
+    busy := make(map[string]int)
+    for n := range p.Completed {
+        if n >= 0 && n < p.N && !tasks[n].done {
+            tasks[n].done, tasks[n].resumed = true, true
+            finished++
+            if p.Status != nil {
+                p.Status[n].Resume()
+            }
+        }
+    }
+    var pending []*phaseTask
+    for _, t := range tasks {
+        if !t.done {
+            pending = append(pending, t)
+        }
+    }
+
+    launch := func(t *phaseTask, worker string, backup bool) {
+        t.attempts++
+        attempt := t.attempts
+        t.running[attempt] = time.Now()
+        t.runningOn[attempt] = worker
+        running++
+        busy[worker]++
+        if p.Status != nil {
+            if backup {
+                p.Status[t.n].Speculate(worker)
+            } else {
+                p.Status[t.n].Start(worker)
+            }
+        }
+        go func() {
+            err := p.Run(t.n, attempt, worker)
+            results <- attemptResult{n: t.n, attempt: attempt, worker: worker, err: err}
+        }()
+    }
+
+    var err error
+    ticker := time.NewTicker(s.CheckInterval)
+    defer ticker.Stop()
+    for finished < p.N && err == nil {
+        for i := 0; i < len(pending); {
+            t := pending[i]
+            if time.Now().Before(t.retryAt) {
+                i++
+                continue
+            }
+            worker := s.pickWorker(busy, t)
+            if worker == "" {
+                break
+            }
+            s.Log.Info("starting task", "phase", p.Name, "task", t.n, "worker", worker)
+            launch(t, worker, false)
+            pending = append(pending[:i], pending[i+1:]...)
+        }
+        if s.Speculative && len(pending) == 0 {
+            if t := s.straggler(tasks); t != nil {
+                if worker := s.pickWorker(busy, t); worker != "" {
+                    s.Log.Info("launching backup attempt", "phase", p.Name, "task", t.n, "attempt", t.attempts+1, "worker", worker)
+                    launch(t, worker, true)
+                }
+            }
+        }
+
+        select {
+        case res := <-results:
+            running--
+            busy[res.worker]--
+            t := tasks[res.n]
+            started := t.running[res.attempt]
+            delete(t.running, res.attempt)
+            delete(t.runningOn, res.attempt)
+            switch {
+            case t.done:
+                s.Log.Info("discarding losing attempt", "phase", p.Name, "task", res.n, "attempt", res.attempt)
+                p.Discard(res.n, res.attempt)
+            case res.err == nil:
+                if err = p.Commit(res.n, res.attempt); err != nil {
+                    err = fmt.Errorf("%s task %d: committing attempt %d: %v", p.Name, res.n, res.attempt, err)
+                }
+                t.done = true
+                t.took = time.Since(started)
+                finished++
+                if p.Status != nil {
+                    p.Status[res.n].Finish(err)
+                }
+            default:
+                p.Discard(res.n, res.attempt)
+                t.failures++
+                t.failedOn[res.worker] = true
+                s.workerFailed(res.worker)
+                switch {
+                case len(t.running) > 0:
+                    s.Log.Warn("attempt failed, another is still running", "phase", p.Name, "task", res.n, "attempt", res.attempt, "worker", res.worker, "err", res.err)
+                case t.failures < s.MaxAttempts:
+                    delay := s.backoff(t.failures)
+                    s.Log.Warn("attempt failed, retrying", "phase", p.Name, "task", res.n, "attempt", res.attempt, "worker", res.worker, "backoff", delay, "err", res.err)
+                    t.retryAt = time.Now().Add(delay)
+                    pending = append(pending, t)
+                    if p.Status != nil {
+                        p.Status[res.n].Retry(res.err)
+                    }
+                case float64(len(p.Failed)+1)*100 <= p.MaxFailedPercent*float64(p.N):
+                    s.Log.Warn("task failed, tolerating it", "phase", p.Name, "task", res.n, "attempts", t.failures, "err", res.err)
+                    t.done = true
+                    p.Failed[res.n] = true
+                    finished++
+                    if p.Status != nil {
+                        p.Status[res.n].Finish(res.err)
+                    }
+                default:
+                    err = fmt.Errorf("%s task %d failed %d times, last on %s: %v", p.Name, res.n, t.failures, res.worker, res.err)
+                    if p.Status != nil {
+                        p.Status[res.n].Finish(res.err)
+                    }
+                }
+            }
+        case <-ticker.C:
+        }
+    }
+
+    // Attempts that lost the race, or that were still running when the
+    // phase failed, are discarded as they come in rather than holding up
+    // whatever comes next.
+    if running > 0 {
+        go func(running int) {
+            for ; running > 0; running-- {
+                res := <-results
+                p.Discard(res.n, res.attempt)
+            }
+        }(running)
+    }
+    return err
+}
+
+// pickWorker chooses the least busy worker with a free slot for an attempt
+// of t, avoiding workers it has already failed on, and then those already
+// running an attempt of it, where it can. It returns "" when every usable
+// worker is full.
+func (s *Scheduler) pickWorker(busy map[string]int, t *phaseTask) string {
+    best := ""
+    for _, w := range s.Workers {
+        if s.blacklisted[w] || busy[w] >= s.Slots {
+            continue
+        }
+        switch {
+        case best == "":
+        case t.failedOn[w] != t.failedOn[best]:
+            if t.failedOn[w] {
+                continue
+            }
+        case t.runsOn(w) != t.runsOn(best):
+            if t.runsOn(w) {
+                continue
+            }
+        case busy[w] >= busy[best]:
+            continue
+        }
+        best = w
+    }
+    return best
+}
+
+// runsOn reports whether an attempt of t is running on worker.
+func (t *phaseTask) runsOn(worker string) bool {
+    for _, w := range t.runningOn {
+        if w == worker {
+            return true
+        }
+    }
+    return false
+}
+
+// backoff is how long to wait before retrying a task that has failed
+// failures times.
+func (s *Scheduler) backoff(failures int) time.Duration {
+    delay := s.Backoff
+    for i := 1; i < failures && delay < s.MaxBackoff; i++ {
+        delay *= 2
+    }
+    if s.MaxBackoff > 0 && delay > s.MaxBackoff {
+        delay = s.MaxBackoff
+    }
+    return delay
+}
+
+// workerFailed counts a failed attempt against worker and blacklists it
+// once it has failed too often.
+func (s *Scheduler) workerFailed(worker string) {
+    if s.workerFailures == nil {
+        s.workerFailures = make(map[string]int)
+        s.blacklisted = make(map[string]bool)
+    }
+    s.workerFailures[worker]++
+    if s.MaxWorkerFailures <= 0 || s.workerFailures[worker] < s.MaxWorkerFailures || s.blacklisted[worker] {
+        return
+    }
+    if len(s.blacklisted)+1 >= len(s.Workers) {
+        if s.workerFailures[worker] == s.MaxWorkerFailures {
+            s.Log.Warn("not blacklisting the last usable worker", "worker", worker, "failures", s.workerFailures[worker])
+        }
+        return
+    }
+    s.blacklisted[worker] = true
+    reason := fmt.Sprintf("%d failed attempts", s.workerFailures[worker])
+    s.Log.Warn("blacklisting worker", "worker", worker, "reason", reason)
+    s.Status.Blacklist(worker, reason)
+}
+
+// straggler picks the running task most worth a backup attempt, or nil.
+func (s *Scheduler) straggler(tasks []*phaseTask) *phaseTask {
+    var took []time.Duration
+    for _, t := range tasks {
+        if t.done && !t.resumed {
+            took = append(took, t.took)
+        }
+    }
+    if len(took) == 0 {
+        return nil
+    }
+    sort.Slice(took, func(i, j int) bool { return took[i] < took[j] })
+    limit := time.Duration(float64(took[len(took)/2]) * s.SlowTaskFactor)
+    // Tasks that all finish in moments would otherwise get backups for
+    // being a few milliseconds behind.
+    if limit < s.MinSlowTaskTime {
+        limit = s.MinSlowTaskTime
+    }
+
+    var slowest *phaseTask
+    var longest time.Duration
+    for _, t := range tasks {
+        if t.done || len(t.running) != 1 || t.attempts > 1 {
+            continue
+        }
+        for _, started := range t.running {
+            if d := time.Since(started); d > limit && d > longest {
+                slowest, longest = t, d
+            }
+        }
+    }
+    return slowest
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "sync"
+    "testing"
+    "time"
+)
+
+func testScheduler(slots int, workers ...string) *Scheduler {
+    s := NewScheduler(slots, NewLogger(io.Discard, LevelError, false))
+    s.Workers = workers
+    s.CheckInterval = 5 * time.Millisecond
+    s.Backoff = time.Millisecond
+    s.MaxBackoff = 10 * time.Millisecond
+    return s
+}
+
+// fakePhase records what the scheduler does with the attempts of a phase
+// whose attempts run is told to run.
+type fakePhase struct {
+    mu          sync.Mutex
+    workers     map[string]string
+    committed   map[int][]int
+    discarded   map[int][]int
+}
+
+func newFakePhase(n int, run func(n, attempt int, worker string) error) (*Phase, *fakePhase) {
+    f := &fakePhase{workers: make(map[string]string), committed: make(map[int][]int), discarded: make(map[int][]int)}
+    p := &Phase{Name: "map", N: n}
+    p.Run = func(n, attempt int, worker string) error {
+        f.mu.Lock()
+        f.workers[fmt.Sprintf("%d/%d", n, attempt)] = worker
+        f.mu.Unlock()
+        return run(n, attempt, worker)
+    }
+    p.Commit = func(n, attempt int) error {
+        f.mu.Lock()
+        defer f.mu.Unlock()
+        f.committed[n] = append(f.committed[n], attempt)
+        return nil
+    }
+    p.Discard = func(n, attempt int) {
+        f.mu.Lock()
+        defer f.mu.Unlock()
+        f.discarded[n] = append(f.discarded[n], attempt)
+    }
+    return p, f
+}
+
+func (f *fakePhase) worker(n, attempt int) string {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return f.workers[fmt.Sprintf("%d/%d", n, attempt)]
+}
+
+// waitDiscarded waits for attempt of task n to be discarded, which happens
+// after RunPhase returns for attempts that lost the race.
+func (f *fakePhase) waitDiscarded(t *testing.T, n, attempt int) {
+    t.Helper()
+    for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+        f.mu.Lock()
+        discarded := fmt.Sprint(f.discarded[n])
+        f.mu.Unlock()
+        if discarded == fmt.Sprint([]int{attempt}) {
+            return
+        }
+    }
+    t.Fatalf("task %d: discarded %v, want [%d]", n, f.discarded[n], attempt)
+}
+
+func TestRunPhaseBackupWins(t *testing.T) {
+    for _, workers := range [][]string{{"local"}, {"a", "b"}} {
+        s := testScheduler(2, workers...)
+        s.Speculative = true
+        s.MinSlowTaskTime = 20 * time.Millisecond
+        release := make(chan struct{})
+        p, f := newFakePhase(3, func(n, attempt int, worker string) error {
+            if n == 2 && attempt == 1 {
+                <-release
+                return nil
+            }
+            time.Sleep(2 * time.Millisecond)
+            return nil
+        })
+        if err := s.RunPhase(p); err != nil {
+            t.Fatalf("workers %v: RunPhase: %v", workers, err)
+        }
+        close(release)
+        f.waitDiscarded(t, 2, 1)
+        for n := 0; n < 3; n++ {
+            want := []int{1}
+            if n == 2 {
+                want = []int{2}
+            }
+            if got := f.committed[n]; fmt.Sprint(got) != fmt.Sprint(want) {
+                t.Errorf("workers %v: task %d committed attempts %v, want %v", workers, n, got, want)
+            }
+        }
+        first, backup := f.worker(2, 1), f.worker(2, 2)
+        if len(workers) > 1 && first == backup {
+            t.Errorf("workers %v: backup ran on %s, the worker of the attempt it backs up", workers, backup)
+        }
+    }
+}
+
+func TestRunPhaseNoBackupBeforeMinSlowTaskTime(t *testing.T) {
+    s := testScheduler(2, "local")
+    s.Speculative = true
+    s.MinSlowTaskTime = time.Hour
+    p, f := newFakePhase(3, func(n, attempt int, worker string) error {
+        if n == 2 {
+            time.Sleep(50 * time.Millisecond)
+        }
+        return nil
+    })
+    if err := s.RunPhase(p); err != nil {
+        t.Fatalf("RunPhase: %v", err)
+    }
+    if got := f.committed[2]; fmt.Sprint(got) != "[1]" || f.worker(2, 2) != "" {
+        t.Errorf("task 2 committed %v with a backup on %q, want [1] and no backup", got, f.worker(2, 2))
+    }
+}
+
+func TestBackoffDoubles(t *testing.T) {
+    s := testScheduler(1, "local")
+    s.Backoff, s.MaxBackoff = time.Second, 5*time.Second
+    for failures, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 10: 5 * time.Second} {
+        if got := s.backoff(failures); got != want {
+            t.Errorf("backoff(%d) = %v, want %v", failures, got, want)
+        }
+    }
+}
+
+func TestRunPhaseBlacklistsFailingWorker(t *testing.T) {
+    s := testScheduler(1, "bad", "good")
+    s.MaxWorkerFailures = 2
+    s.Status = NewJobStatus("job", 6, 1, "in", "out")
+    var mu sync.Mutex
+    onBad := 0
+    p, f := newFakePhase(6, func(n, attempt int, worker string) error {
+        if worker == "bad" {
+            mu.Lock()
+            onBad++
+            mu.Unlock()
+            return fmt.Errorf("disk on fire")
+        }
+        time.Sleep(20 * time.Millisecond)
+        return nil
+    })
+    if err := s.RunPhase(p); err != nil {
+        t.Fatalf("RunPhase: %v", err)
+    }
+    if !s.blacklisted["bad"] || s.blacklisted["good"] {
+        t.Errorf("blacklisted %v, want only bad", s.blacklisted)
+    }
+    if onBad != 2 {
+        t.Errorf("%d attempts ran on the bad worker, want 2", onBad)
+    }
+    if got := s.Status.Blacklisted["bad"]; got != "2 failed attempts" {
+        t.Errorf("status gives %q as the reason, want %q", got, "2 failed attempts")
+    }
+    for n := 0; n < 6; n++ {
+        if len(f.committed[n]) != 1 {
+            t.Errorf("task %d committed %v, want one attempt", n, f.committed[n])
+        }
+    }
+}
+
+func TestRunPhaseKeepsLastWorker(t *testing.T) {
+    s := testScheduler(2, "only")
+    s.MaxWorkerFailures = 1
+    p, _ := newFakePhase(3, func(n, attempt int, worker string) error {
+        if attempt == 1 {
+            return fmt.Errorf("flaky")
+        }
+        return nil
+    })
+    if err := s.RunPhase(p); err != nil {
+        t.Fatalf("RunPhase: %v", err)
+    }
+    if s.blacklisted["only"] {
+        t.Errorf("the last worker was blacklisted")
+    }
+}
+
+func TestRunPhaseMaxFailedPercent(t *testing.T) {
+    for _, tt := range []struct {
+        percent float64
+        bad     []int
+        ok      bool
+    }{
+        {0, []int{3}, false},
+        {10, []int{3}, true},
+        {10, []int{3, 7}, false},
+        {20, []int{3, 7}, true},
+    } {
+        s := testScheduler(2, "local")
+        s.MaxAttempts = 2
+        bad := make(map[int]bool)
+        for _, n := range tt.bad {
+            bad[n] = true
+        }
+        p, f := newFakePhase(10, func(n, attempt int, worker string) error {
+            if bad[n] {
+                return fmt.Errorf("bad input")
+            }
+            return nil
+        })
+        p.MaxFailedPercent = tt.percent
+        err := s.RunPhase(p)
+        if (err == nil) != tt.ok {
+            t.Errorf("%v%% with %v failing: RunPhase = %v, want ok %v", tt.percent, tt.bad, err, tt.ok)
+            continue
+        }
+        if !tt.ok {
+            continue
+        }
+        if fmt.Sprint(p.Failed) != fmt.Sprint(bad) {
+            t.Errorf("%v%%: Failed = %v, want %v", tt.percent, p.Failed, bad)
+        }
+        for n := range bad {
+            if len(f.committed[n]) != 0 {
+                t.Errorf("%v%%: failed task %d was committed", tt.percent, n)
+            }
+        }
+    }
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/hex"
+    "encoding/pem"
+    "fmt"
+    "math/big"
+    "net"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// SignedURLValidity is how long a signed URL can be fetched for.
+var SignedURLValidity = 24 * time.Hour
+
+// shuffle is how this process serves and fetches job files: the scheme of
+// the URLs makeURL hands out, the client HTTPStorage fetches them with,
+// and the key URLs of each job are signed with. A job without a key gets
+// plain URLs.
+var shuffle = struct {
+    sync.Mutex
+    scheme  string
+    client  *http.Client
+    keys    map[string][]byte
+}{scheme: "http", client: http.DefaultClient, keys: make(map[string][]byte)}
+
+func shuffleScheme() string {
+    shuffle.Lock()
+    defer shuffle.Unlock()
+    return shuffle.scheme
+}
+
+func shuffleClient() *http.Client {
+    shuffle.Lock()
+    defer shuffle.Unlock()
+    return shuffle.client
+}
+
+// SignJobURLs gives job a fresh random key, so that makeURL signs the URLs
+// of its files and requireSignature serves them only with a valid
+// signature.
+func SignJobURLs(job string) error {
+    key := make([]byte, 32)
+    if _, err := rand.Read(key); err != nil {
+        return err
+    }
+    shuffle.Lock()
+    defer shuffle.Unlock()
+    shuffle.keys[job] = key
+    return nil
+}
+
+// jobURLKey is the key job's URLs are signed with, nil when they are not.
+func jobURLKey(job string) []byte {
+    shuffle.Lock()
+    defer shuffle.Unlock()
+    return shuffle.keys[job]
+}
+
+// useJobURLKey signs job's URLs with the key its coordinator made, which
+// workers are handed with every attempt. A nil key leaves them unsigned.
+func useJobURLKey(job string, key []byte) {
+    if key == nil {
+        return
+    }
+    shuffle.Lock()
+    defer shuffle.Unlock()
+    shuffle.keys[job] = key
+}
+
+// jobKey returns the key of the job file belongs to. Every file of a job
+// starts with its ID and an underscore.
+func jobKey(file string) ([]byte, bool) {
+    shuffle.Lock()
+    defer shuffle.Unlock()
+    for job, key := range shuffle.keys {
+        if strings.HasPrefix(file, job+"_") {
+            return key, true
+        }
+    }
+    return nil, false
+}
+
+func urlSignature(key []byte, file string, expires int64) string {
+    mac := hmac.New(sha256.New, key)
+    fmt.Fprintf(mac, "%s\n%d", file, expires)
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signURL adds an expiry and a signature over file and the expiry to u,
+// when the job file belongs to has a key.
+func signURL(u, file string) string {
+    key, ok := jobKey(file)
+    if !ok {
+        return u
+    }
+    expires := time.Now().Add(SignedURLValidity).Unix()
+    return fmt.Sprintf("%s?expires=%d&sig=%s", u, expires, urlSignature(key, file, expires))
+}
+
+// requireSignature serves a file only to requests whose URL makeURL signed
+// with the key of the file's job and that have not expired. Files of jobs
+// without a key, and anything that is not a file, are refused.
+func requireSignature(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        file := strings.TrimPrefix(r.URL.Path, "/")
+        key, ok := jobKey(file)
+        if !ok || strings.Contains(file, "/") {
+            http.Error(w, "forbidden", http.StatusForbidden)
+            return
+        }
+        query := r.URL.Query()
+        expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+        if err != nil || time.Now().Unix() > expires {
+            http.Error(w, "URL has expired", http.StatusForbidden)
+            return
+        }
+        if !hmac.Equal([]byte(query.Get("sig")), []byte(urlSignature(key, file, expires))) {
+            http.Error(w, "bad signature", http.StatusForbidden)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// redactURL drops the signature from a URL, for logs.
+func redactURL(u string) string {
+    parsed, err := url.Parse(u)
+    if err != nil || parsed.RawQuery == "" {
+        return u
+    }
+    query := parsed.Query()
+    if query.Get("sig") != "" {
+        query.Set("sig", "REDACTED")
+    }
+    parsed.RawQuery = query.Encode()
+    return parsed.String()
+}
+
+// setupTLS makes this process serve /data/ over TLS on address and trust
+// only its certificate authority when fetching. The authority lives in dir
+// as ca.pem and ca-key.pem and is created on first use; give the same dir
+// to every coordinator and worker of a cluster. A certificate for address,
+// signed by it, is issued on every start. It returns the server's config.
+func setupTLS(dir, address string) (*tls.Config, error) {
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return nil, err
+    }
+    ca, caKey, err := loadOrCreateCA(dir)
+    if err != nil {
+        return nil, fmt.Errorf("certificate authority: %v", err)
+    }
+    cert, err := issueCertificate(ca, caKey, address)
+    if err != nil {
+        return nil, fmt.Errorf("issuing certificate for %s: %v", address, err)
+    }
+    pool := x509.NewCertPool()
+    pool.AddCert(ca)
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+    shuffle.Lock()
+    shuffle.scheme = "https"
+    shuffle.client = &http.Client{Transport: transport}
+    shuffle.Unlock()
+    return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+func loadOrCreateCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+    certPath, keyPath := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+    certPEM, certErr := os.ReadFile(certPath)
+    keyPEM, keyErr := os.ReadFile(keyPath)
+    if certErr == nil && keyErr == nil {
+        return parseCA(certPEM, keyPEM)
+    }
+    // Only a directory with neither file gets a new authority: replacing
+    // one whose key is missing or unreadable would cut off every process
+    // that trusts the old one.
+    switch {
+    case certErr != nil && !os.IsNotExist(certErr):
+        return nil, nil, certErr
+    case keyErr != nil && !os.IsNotExist(keyErr):
+        return nil, nil, keyErr
+    case certErr == nil:
+        return nil, nil, fmt.Errorf("%s exists but %s does not", certPath, keyPath)
+    case keyErr == nil:
+        return nil, nil, fmt.Errorf("%s exists but %s does not", keyPath, certPath)
+    }
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return nil, nil, err
+    }
+    template := &x509.Certificate{
+        SerialNumber:           newSerial(),
+        Subject:                pkix.Name{CommonName: "mapreduce local CA"},
+        NotBefore:              time.Now().Add(-time.Hour),
+        NotAfter:               time.Now().AddDate(10, 0, 0),
+        KeyUsage:               x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+        BasicConstraintsValid:  true,
+        IsCA:                   true,
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        return nil, nil, err
+    }
+    keyDER, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        return nil, nil, err
+    }
+    certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+    keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+    if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+        return nil, nil, err
+    }
+    if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+        return nil, nil, err
+    }
+    logger.Info("created certificate authority", "cert", certPath)
+    return parseCA(certPEM, keyPEM)
+}
+
+func parseCA(certPEM, keyPEM []byte) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+    certBlock, _ := pem.Decode(certPEM)
+    keyBlock, _ := pem.Decode(keyPEM)
+    if certBlock == nil || keyBlock == nil {
+        return nil, nil, fmt.Errorf("no PEM data")
+    }
+    cert, err := x509.ParseCertificate(certBlock.Bytes)
+    if err != nil {
+        return nil, nil, err
+    }
+    key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+    if err != nil {
+        return nil, nil, err
+    }
+    return cert, key, nil
+}
+
+// issueCertificate signs a server certificate for the host of address, and
+// for localhost.
+func issueCertificate(ca *x509.Certificate, caKey *ecdsa.PrivateKey, address string) (tls.Certificate, error) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return tls.Certificate{}, err
+    }
+    host, _, err := net.SplitHostPort(address)
+    if err != nil {
+        host = address
+    }
+    template := &x509.Certificate{
+        SerialNumber:   newSerial(),
+        Subject:        pkix.Name{CommonName: host},
+        NotBefore:      time.Now().Add(-time.Hour),
+        NotAfter:       time.Now().AddDate(1, 0, 0),
+        KeyUsage:       x509.KeyUsageDigitalSignature,
+        ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+        DNSNames:       []string{"localhost"},
+        IPAddresses:    []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+    }
+    if ip := net.ParseIP(host); ip != nil {
+        template.IPAddresses = append(template.IPAddresses, ip)
+    } else if host != "" && host != "localhost" {
+        template.DNSNames = append(template.DNSNames, host)
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+    if err != nil {
+        return tls.Certificate{}, err
+    }
+    return tls.Certificate{Certificate: [][]byte{der, ca.Raw}, PrivateKey: key}, nil
+}
+
+func newSerial() *big.Int {
+    serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+    return serial
+}
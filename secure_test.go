@@ -0,0 +1,71 @@
+package main
+
+import (
+    "bytes"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestLoadOrCreateCA(t *testing.T) {
+    dir := t.TempDir()
+    ca, _, err := loadOrCreateCA(dir)
+    if err != nil {
+        t.Fatalf("creating: %v", err)
+    }
+    again, _, err := loadOrCreateCA(dir)
+    if err != nil {
+        t.Fatalf("loading: %v", err)
+    }
+    if !bytes.Equal(again.Raw, ca.Raw) {
+        t.Errorf("loading gave a different authority than the one created")
+    }
+}
+
+func TestLoadOrCreateCAKeepsHalfAuthority(t *testing.T) {
+    for _, missing := range []string{"ca.pem", "ca-key.pem"} {
+        dir := t.TempDir()
+        if _, _, err := loadOrCreateCA(dir); err != nil {
+            t.Fatal(err)
+        }
+        kept := "ca.pem"
+        if missing == kept {
+            kept = "ca-key.pem"
+        }
+        before, err := os.ReadFile(filepath.Join(dir, kept))
+        if err != nil {
+            t.Fatal(err)
+        }
+        os.Remove(filepath.Join(dir, missing))
+        if _, _, err := loadOrCreateCA(dir); err == nil {
+            t.Errorf("without %s: loaded an authority, want an error", missing)
+        }
+        after, err := os.ReadFile(filepath.Join(dir, kept))
+        if err != nil || !bytes.Equal(after, before) {
+            t.Errorf("without %s: %s was replaced", missing, kept)
+        }
+        if _, err := os.Stat(filepath.Join(dir, missing)); !os.IsNotExist(err) {
+            t.Errorf("without %s: it was created again", missing)
+        }
+    }
+}
+
+func TestLoadOrCreateCAUnreadableKey(t *testing.T) {
+    dir := t.TempDir()
+    if _, _, err := loadOrCreateCA(dir); err != nil {
+        t.Fatal(err)
+    }
+    cert, _ := os.ReadFile(filepath.Join(dir, "ca.pem"))
+    keyPath := filepath.Join(dir, "ca-key.pem")
+    os.Remove(keyPath)
+    // A directory where the key should be cannot be read as one.
+    if err := os.Mkdir(keyPath, 0700); err != nil {
+        t.Fatal(err)
+    }
+    if _, _, err := loadOrCreateCA(dir); err == nil {
+        t.Errorf("loaded an authority with an unreadable key, want an error")
+    }
+    if after, _ := os.ReadFile(filepath.Join(dir, "ca.pem")); !bytes.Equal(after, cert) {
+        t.Errorf("ca.pem was replaced")
+    }
+}
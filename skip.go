@@ -0,0 +1,377 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// Bad-record skipping. A task in skipping mode calls user code one record
+// (one key group, on the reduce side) at a time and holds back what it
+// emits until the call returns. A record the call errors or panics on is
+// written to the attempt's quarantine table instead of failing the task,
+// and whatever it emitted is dropped.
+//
+// A map call sees a single record, so the record it fails on is the bad
+// one. A reduce call sees a whole key group, which is copied to a spill
+// file as it is read. When the reducer fails on a group, the group is read
+// back and bisected, each half reduced again on its own, until the values
+// the reducer fails on are singled out. Only those are quarantined, and the
+// group is reduced once more without them.
+//
+// Skipping mode is not the default: the job turns it on for attempts after
+// the first SkipAfter ones have failed, so that a task which fails for other
+// reasons, or whose records are all fine, is not slowed down.
+
+// quarantineFile is where an attempt of task n writes the records it
+// skipped. It is committed with the rest of the attempt's output.
+func quarantineFile(job, phase string, n int) string {
+    return fmt.Sprintf("%s_quarantine_%s_%d.db", job, phase, n)
+}
+
+// skipSpillFile is where a reduce task in skipping mode copies the key
+// group it is reducing.
+func skipSpillFile(job string, n int) string {return fmt.Sprintf("%s_reduce_%d_spill.rec", job, n)}
+
+// quarantineOutput is where the skipped records of a whole job end up, e.g.
+// result_quarantine.db for result.db.
+func quarantineOutput(output string) string {
+    return strings.TrimSuffix(output, ".db") + "_quarantine.db"
+}
+
+const quarantineTable = `CREATE TABLE IF NOT EXISTS quarantine(
+    phase text, task integer, attempt integer, record integer, key text, value text, error text)`
+
+// Quarantine is the table an attempt writes skipped records to. The file is
+// only created once there is something to put in it.
+type Quarantine struct {
+    path            string
+    phase           string
+    task, attempt   int
+    db              *sql.DB
+    stmt            *sql.Stmt
+    count           int64
+}
+
+func newQuarantine(dir, job, phase string, n, attempt int) *Quarantine {
+    return &Quarantine{path: filepath.Join(dir, quarantineFile(job, phase, n)), phase: phase, task: n, attempt: attempt}
+}
+
+// Add records that the record-th record of the task's input, key and value,
+// failed with cause.
+func (q *Quarantine) Add(record int64, key, value string, cause error) error {
+    if q.db == nil {
+        db, err := createDatabase(q.path)
+        if err != nil {
+            return err
+        }
+        if _, err := db.Exec(quarantineTable); err != nil {
+            db.Close()
+            return err
+        }
+        if q.stmt, err = db.Prepare("INSERT INTO quarantine VALUES(?, ?, ?, ?, ?, ?, ?)"); err != nil {
+            db.Close()
+            return err
+        }
+        q.db = db
+    }
+    q.count++
+    _, err := q.stmt.Exec(q.phase, q.task, q.attempt, record, key, value, cause.Error())
+    return err
+}
+
+func (q *Quarantine) Close() error {
+    if q.db == nil {
+        return nil
+    }
+    q.stmt.Close()
+    return q.db.Close()
+}
+
+// checkLimit fails the task once it has skipped more than max records. A
+// max of 0 skips any number of them.
+func (q *Quarantine) checkLimit(max int64) error {
+    if max > 0 && q.count > max {
+        return fmt.Errorf("skipped %d bad records, more than the %d allowed", q.count, max)
+    }
+    return nil
+}
+
+// collectCall runs call with an output channel of its own and returns what
+// it emitted, or the error or panic it failed with.
+func collectCall(call func(output chan<- Pair) error) ([]Pair, error) {
+    output := make(chan Pair, 100)
+    collected := make(chan []Pair)
+    go func() {
+        var pairs []Pair
+        for pair := range output {
+            pairs = append(pairs, pair)
+        }
+        collected <- pairs
+    }()
+    err := call(output)
+    if err != nil {
+        // Let the collector finish, then drop what it got.
+        closeQuietly(output)
+        <-collected
+        return nil, err
+    }
+    closeQuietly(output)
+    return <-collected, nil
+}
+
+// skipMap maps one record in skipping mode and writes its output, or
+// quarantines the record if the mapper fails on it.
+func (task *MapTask) skipMap(ctx *TaskContext, mapper Mapper, tag string, record int64, pair Pair, q *Quarantine, outputs map[string]pairWriter) error {
+    pairs, err := collectCall(func(output chan<- Pair) error {
+        return runMap(ctx, mapper, pair.Key, pair.Value, output)
+    })
+    if err != nil {
+        ctx.Log.Warn("skipping bad record", "record", record, "key", pair.Key, "err", err)
+        task.Counters.Increment(CounterMapSkippedRecords, 1)
+        if err := q.Add(record, pair.Key, pair.Value, err); err != nil {
+            return fmt.Errorf("quarantining record %d: %v", record, err)
+        }
+        return q.checkLimit(task.MaxSkippedRecords)
+    }
+    output := make(chan Pair, 100)
+    finished := make(chan error)
+    go task.writeOutput(output, finished, outputs)
+    for _, p := range pairs {
+        if tag != "" {
+            p.Value = tagValue(tag, p.Value)
+        }
+        output <- p
+    }
+    close(output)
+    return <-finished
+}
+
+// skipReduce is the reduce loop in skipping mode: each key group is reduced
+// on its own while it is copied to spill, and a group the reducer fails on
+// is narrowed down to the values it fails on.
+func (task *ReduceTask) skipReduce(ctx *TaskContext, client Interface, input pairSource, stmt *sql.Stmt, q *Quarantine, spill string) error {
+    defer os.Remove(spill)
+    var record int64
+    pair, readErr := input.Next()
+    for readErr == nil {
+        key, first := pair.Key, record
+        task.Counters.Increment(CounterReduceInputGroups, 1)
+        w, err := CreateRecordFile(spill, false, false)
+        if err != nil {
+            return err
+        }
+        pairs, failed, err := reduceGroup(ctx, client, key, func(values chan<- string) error {
+            for readErr == nil && pair.Key == key {
+                task.Counters.Increment(CounterReduceInputRecords, 1)
+                metricRecordsRead.Inc("reduce")
+                if err := w.Write(key, pair.Value); err != nil {
+                    return err
+                }
+                values <- pair.Value
+                record++
+                pair, readErr = input.Next()
+            }
+            return w.Close()
+        })
+        w.Close()
+        if err != nil {
+            return fmt.Errorf("spilling key %q: %v", key, err)
+        }
+        if failed != nil {
+            if pairs, err = task.narrowDown(ctx, client, key, spill, first, record-first, failed, q); err != nil {
+                return err
+            }
+        }
+        task.Progress.Advance(1)
+        for _, p := range pairs {
+            if _, err := stmt.Exec(p.Key, p.Value); err != nil {
+                return fmt.Errorf("issue inserting: %v", err)
+            }
+            task.Counters.Increment(CounterReduceOutputRecords, 1)
+            metricRecordsEmitted.Inc("reduce")
+        }
+    }
+    if readErr != io.EOF {
+        return readErr
+    }
+    return nil
+}
+
+// reduceGroup reduces key over the values send sends and returns what the
+// reducer emitted, or the error or panic it failed with as failed. Values
+// the reducer leaves unread are taken and dropped. err is send's own
+// failure.
+func reduceGroup(ctx *TaskContext, client Interface, key string, send func(values chan<- string) error) (pairs []Pair, failed, err error) {
+    values := make(chan string, 100)
+    reduced := make(chan error)
+    go func() {
+        var err error
+        pairs, err = collectCall(func(output chan<- Pair) error {
+            return runReduce(ctx, client, key, values, output)
+        })
+        for range values {
+        }
+        reduced <- err
+    }()
+    err = send(values)
+    close(values)
+    failed = <-reduced
+    return pairs, failed, err
+}
+
+// valueRange is the values lo up to hi of a spilled key group.
+type valueRange struct {
+    lo, hi  int64
+    err     error
+}
+
+// sendSpilled sends values lo up to hi of the key group in spill, leaving
+// out those in skip, which is sorted.
+func sendSpilled(spill string, lo, hi int64, skip []valueRange) func(values chan<- string) error {
+    return func(values chan<- string) error {
+        r, err := OpenRecordFile(spill)
+        if err != nil {
+            return err
+        }
+        defer r.Close()
+        rest := skip
+        for i := int64(0); i < hi; i++ {
+            pair, err := r.Next()
+            if err != nil {
+                return err
+            }
+            for len(rest) > 0 && rest[0].hi <= i {
+                rest = rest[1:]
+            }
+            if i >= lo && (len(rest) == 0 || i < rest[0].lo) {
+                values <- pair.Value
+            }
+        }
+        return nil
+    }
+}
+
+// narrowDown finds the values of the group of key, the n values in spill
+// after the first records of the task's input, that the reducer fails on.
+// It bisects the group, reducing each half on its own, down to single
+// values, or to a range whose halves only fail together. It quarantines
+// those values and returns the output of the group without them.
+func (task *ReduceTask) narrowDown(ctx *TaskContext, client Interface, key, spill string, first, n int64, cause error, q *Quarantine) ([]Pair, error) {
+    var bad []valueRange
+    var bisect func(lo, hi int64, cause error) error
+    bisect = func(lo, hi int64, cause error) error {
+        if hi-lo == 1 {
+            bad = append(bad, valueRange{lo, hi, cause})
+            return nil
+        }
+        mid := lo + (hi-lo)/2
+        var halves []valueRange
+        for _, half := range []valueRange{{lo: lo, hi: mid}, {lo: mid, hi: hi}} {
+            _, failed, err := reduceGroup(ctx, client, key, sendSpilled(spill, half.lo, half.hi, nil))
+            if err != nil {
+                return err
+            }
+            if failed != nil {
+                halves = append(halves, valueRange{half.lo, half.hi, failed})
+            }
+        }
+        if len(halves) == 0 {
+            bad = append(bad, valueRange{lo, hi, cause})
+        }
+        for _, half := range halves {
+            if err := bisect(half.lo, half.hi, half.err); err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+    if err := bisect(0, n, cause); err != nil {
+        return nil, fmt.Errorf("narrowing down key %q: %v", key, err)
+    }
+    left := n
+    for _, r := range bad {
+        left -= r.hi - r.lo
+    }
+    // With some values left, the group is reduced once more without the
+    // bad ones. If the reducer fails on those as well, the whole group
+    // goes.
+    var pairs []Pair
+    if left > 0 {
+        var failed, err error
+        pairs, failed, err = reduceGroup(ctx, client, key, sendSpilled(spill, 0, n, bad))
+        if err != nil {
+            return nil, fmt.Errorf("narrowing down key %q: %v", key, err)
+        }
+        if failed != nil {
+            pairs, bad = nil, []valueRange{{0, n, failed}}
+        }
+    }
+
+    skipped, err := task.quarantineRanges(key, spill, first, bad, q)
+    if err != nil {
+        return nil, err
+    }
+    ctx.Log.Warn("skipping bad values", "key", key, "skipped", skipped, "values", n, "err", bad[0].err)
+    task.Counters.Increment(CounterReduceSkippedGroups, 1)
+    task.Counters.Increment(CounterReduceSkippedRecords, skipped)
+    return pairs, q.checkLimit(task.MaxSkippedRecords)
+}
+
+// quarantineRanges quarantines the values in bad of the group of key in
+// spill, and returns how many there were.
+func (task *ReduceTask) quarantineRanges(key, spill string, first int64, bad []valueRange, q *Quarantine) (int64, error) {
+    r, err := OpenRecordFile(spill)
+    if err != nil {
+        return 0, err
+    }
+    defer r.Close()
+    var skipped int64
+    for i, rest := int64(0), bad; len(rest) > 0; i++ {
+        pair, err := r.Next()
+        if err != nil {
+            return skipped, err
+        }
+        if i < rest[0].lo {
+            continue
+        }
+        if err := q.Add(first+i+1, key, pair.Value, rest[0].err); err != nil {
+            return skipped, fmt.Errorf("quarantining key %q: %v", key, err)
+        }
+        skipped++
+        if i+1 == rest[0].hi {
+            rest = rest[1:]
+        }
+    }
+    return skipped, nil
+}
+
+// collectQuarantine gathers the quarantine tables of every committed task
+// of job in dir into one database at output, and returns how many records
+// it holds. Nothing is written when no record was skipped.
+func collectQuarantine(dir, job, output string) (int64, error) {
+    files, err := filepath.Glob(filepath.Join(dir, job+"_quarantine_*.db"))
+    if err != nil || len(files) == 0 {
+        return 0, err
+    }
+    os.Remove(output)
+    db, err := createDatabase(output)
+    if err != nil {
+        return 0, err
+    }
+    defer db.Close()
+    if _, err := db.Exec(quarantineTable); err != nil {
+        return 0, err
+    }
+    for _, file := range files {
+        if _, err := db.Exec("attach ? as merge; insert into quarantine select * from merge.quarantine; detach merge", file); err != nil {
+            return 0, fmt.Errorf("collecting %s: %v", filepath.Base(file), err)
+        }
+    }
+    var count int64
+    err = db.QueryRow("SELECT count(*) FROM quarantine").Scan(&count)
+    return count, err
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "path/filepath"
+    "strconv"
+    "testing"
+)
+
+// badValues maps and reduces numbers, failing on any value that is not
+// one, and panicking on "panic".
+type badValues struct{}
+
+func (badValues) Map(key, value string, output chan<- Pair) error {
+    if value == "panic" {
+        panic("mapper panicked")
+    }
+    if _, err := strconv.Atoi(value); err != nil {
+        return err
+    }
+    output <- Pair{key, value}
+    return nil
+}
+
+func (badValues) Reduce(key string, values <-chan string, output chan<- Pair) error {
+    sum := 0
+    for value := range values {
+        if value == "panic" {
+            panic("reducer panicked")
+        }
+        n, err := strconv.Atoi(value)
+        if err != nil {
+            return err
+        }
+        sum += n
+    }
+    output <- Pair{key, strconv.Itoa(sum)}
+    return nil
+}
+
+// pairList is a map output that keeps what is written to it.
+type pairList struct {
+    pairs   []Pair
+}
+
+func (l *pairList) Write(key, value string) error {
+    l.pairs = append(l.pairs, Pair{key, value})
+    return nil
+}
+
+func (l *pairList) Close() error {return nil}
+
+// quarantined reads back the key, value and record number of each record
+// in the quarantine table at path.
+func quarantined(t *testing.T, path string) []string {
+    t.Helper()
+    db, err := openDatabase(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    rows, err := db.Query("SELECT key, value, record FROM quarantine ORDER BY record")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer rows.Close()
+    var records []string
+    for rows.Next() {
+        var key, value string
+        var record int64
+        if err := rows.Scan(&key, &value, &record); err != nil {
+            t.Fatal(err)
+        }
+        records = append(records, fmt.Sprintf("%s=%s@%d", key, value, record))
+    }
+    return records
+}
+
+func testTaskContext(phase string, counters *Counters) *TaskContext {
+    return &TaskContext{Phase: phase, Counters: counters, Log: NewLogger(io.Discard, LevelError, false)}
+}
+
+func TestSkipMapQuarantinesBadRecords(t *testing.T) {
+    dir := t.TempDir()
+    task := &MapTask{R: 1, N: 0, JobID: "job", Counters: NewCounters()}
+    out := &pairList{}
+    outputs := map[string]pairWriter{task.outputFile(0): out}
+    q := newQuarantine(dir, "job", "map", 0, 3)
+    ctx := testTaskContext("map", task.Counters)
+    for i, value := range []string{"1", "x", "2", "panic", "3"} {
+        if err := task.skipMap(ctx, badValues{}, "", int64(i+1), Pair{"k", value}, q, outputs); err != nil {
+            t.Fatalf("record %d: %v", i+1, err)
+        }
+    }
+    q.Close()
+    if got := fmt.Sprint(out.pairs); got != "[{k 1} {k 2} {k 3}]" {
+        t.Errorf("map output %s, want the good records", got)
+    }
+    if got := fmt.Sprint(quarantined(t, filepath.Join(dir, quarantineFile("job", "map", 0)))); got != "[k=x@2 k=panic@4]" {
+        t.Errorf("quarantined %s, want records 2 and 4", got)
+    }
+    if got := task.Counters.Get(CounterMapSkippedRecords); got != 2 {
+        t.Errorf("%d skipped records counted, want 2", got)
+    }
+}
+
+func TestSkipMapMaxSkippedRecords(t *testing.T) {
+    dir := t.TempDir()
+    task := &MapTask{R: 1, N: 0, JobID: "job", Counters: NewCounters(), MaxSkippedRecords: 1}
+    outputs := map[string]pairWriter{task.outputFile(0): &pairList{}}
+    q := newQuarantine(dir, "job", "map", 0, 3)
+    defer q.Close()
+    ctx := testTaskContext("map", task.Counters)
+    if err := task.skipMap(ctx, badValues{}, "", 1, Pair{"k", "x"}, q, outputs); err != nil {
+        t.Fatalf("first bad record: %v", err)
+    }
+    if err := task.skipMap(ctx, badValues{}, "", 2, Pair{"k", "y"}, q, outputs); err == nil {
+        t.Errorf("skipped a second bad record with at most 1 allowed")
+    }
+}
+
+func TestSkipReduceNarrowsDownBadValues(t *testing.T) {
+    dir := t.TempDir()
+    input := filepath.Join(dir, "input.rec")
+    // Record numbers count from 1 across the whole input.
+    writeRecords(t, input, false, false, []Pair{
+        {"a", "1"}, {"a", "2"}, {"a", "x"}, {"a", "3"},                 // 1-4: one bad value
+        {"b", "panic"}, {"b", "4"}, {"b", "5"}, {"b", "y"}, {"b", "6"}, // 5-9: two
+        {"c", "7"},                                                     // 10
+        {"d", "z"},                                                     // 11: nothing good left
+    })
+    source, err := OpenRecordFile(input)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer source.Close()
+
+    db, err := createDatabase(filepath.Join(dir, "output.db"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    stmt, err := db.Prepare("INSERT INTO pairs VALUES(?, ?)")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer stmt.Close()
+
+    task := &ReduceTask{N: 0, JobID: "job", Counters: NewCounters(), Progress: NewTaskProgress()}
+    q := newQuarantine(dir, "job", "reduce", 0, 3)
+    err = task.skipReduce(testTaskContext("reduce", task.Counters), badValues{}, source, stmt, q, filepath.Join(dir, skipSpillFile("job", 0)))
+    q.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    rows, err := db.Query("SELECT key, value FROM pairs ORDER BY key")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer rows.Close()
+    var output []string
+    for rows.Next() {
+        var key, value string
+        rows.Scan(&key, &value)
+        output = append(output, key+"="+value)
+    }
+    if got := fmt.Sprint(output); got != "[a=6 b=15 c=7]" {
+        t.Errorf("reduced %s, want the good values of every group", got)
+    }
+    if got := fmt.Sprint(quarantined(t, filepath.Join(dir, quarantineFile("job", "reduce", 0)))); got != "[a=x@3 b=panic@5 b=y@8 d=z@11]" {
+        t.Errorf("quarantined %s, want only the bad values", got)
+    }
+    if got := task.Counters.Get(CounterReduceSkippedGroups); got != 3 {
+        t.Errorf("%d skipped groups counted, want 3", got)
+    }
+    if got := task.Counters.Get(CounterReduceSkippedRecords); got != 4 {
+        t.Errorf("%d skipped records counted, want 4", got)
+    }
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "html/template"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+type TaskState string
+
+const (
+    TaskPending TaskState = "pending"
+    TaskRunning TaskState = "running"
+    TaskDone    TaskState = "done"
+    TaskFailed  TaskState = "failed"
+)
+
+// TaskStatus is the coordinator's view of one map or reduce task.
+type TaskStatus struct {
+    Phase       string
+    N           int
+    Host        string
+    State       TaskState
+    Started     time.Time
+    Finished    time.Time
+    Err         string
+    Attempts    int
+    Speculative int
+    Failures    int
+    Resumed     bool
+
+    counters    *Counters
+    progress    *TaskProgress
+    job         *JobStatus
+}
+
+// JobStatus tracks a running job for the status page. All of its methods
+// are safe to call while the page is being served.
+type JobStatus struct {
+    mu          sync.Mutex
+    ID          string
+    M, R        int
+    Source      string
+    Output      string
+    CacheFiles  []string
+    Phase       string
+    Started     time.Time
+    Finished    time.Time
+    Reason      string
+    Blacklisted map[string]string
+    tasks       []*TaskStatus
+}
+
+func NewJobStatus(id string, m, r int, source, output string) *JobStatus {
+    return &JobStatus{ID: id, M: m, R: r, Source: source, Output: output, Phase: "starting", Started: time.Now()}
+}
+
+// newJobID makes an ID that is unique across runs on one machine.
+func newJobID() string {
+    return fmt.Sprintf("job_%s_%d", time.Now().Format("20060102_150405"), os.Getpid())
+}
+
+func (s *JobStatus) SetPhase(phase string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.Phase = phase
+    if phase == "done" || phase == "failed" {
+        s.Finished = time.Now()
+    }
+}
+
+// Fail marks the job failed and records why.
+func (s *JobStatus) Fail(reason string) {
+    s.SetPhase("failed")
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.Reason = reason
+}
+
+// Blacklist records that the scheduler stopped giving worker attempts.
+func (s *JobStatus) Blacklist(worker, reason string) {
+    if s == nil {
+        return
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.Blacklisted == nil {
+        s.Blacklisted = make(map[string]string)
+    }
+    s.Blacklisted[worker] = reason
+}
+
+// AddTask registers a pending task whose counters and progress the task
+// itself updates as it runs.
+func (s *JobStatus) AddTask(phase string, n int, host string, counters *Counters, progress *TaskProgress) *TaskStatus {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    t := &TaskStatus{Phase: phase, N: n, Host: host, State: TaskPending, counters: counters, progress: progress, job: s}
+    s.tasks = append(s.tasks, t)
+    return t
+}
+
+func (t *TaskStatus) Start(host string) {
+    t.job.mu.Lock()
+    defer t.job.mu.Unlock()
+    t.Host = host
+    t.State = TaskRunning
+    t.Started = time.Now()
+    t.Finished = time.Time{}
+    t.Attempts++
+}
+
+// Resume marks a task finished by an earlier run of the job.
+func (t *TaskStatus) Resume() {
+    t.job.mu.Lock()
+    defer t.job.mu.Unlock()
+    t.State = TaskDone
+    t.Resumed = true
+}
+
+// Speculate records a backup attempt of a task that is already running.
+func (t *TaskStatus) Speculate(host string) {
+    t.job.mu.Lock()
+    defer t.job.mu.Unlock()
+    t.Host = host
+    t.Attempts++
+    t.Speculative++
+}
+
+// Retry records a failed attempt of a task that will be tried again.
+func (t *TaskStatus) Retry(err error) {
+    t.job.mu.Lock()
+    defer t.job.mu.Unlock()
+    t.State = TaskPending
+    t.Err = err.Error()
+    t.Failures++
+}
+
+// SetAttempt points the task at the counters and progress of the attempt
+// whose output it ended up with.
+func (t *TaskStatus) SetAttempt(counters *Counters, progress *TaskProgress) {
+    t.job.mu.Lock()
+    defer t.job.mu.Unlock()
+    t.counters, t.progress = counters, progress
+}
+
+// Counters adds up the counters of every task.
+func (s *JobStatus) Counters() *Counters {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    total := NewCounters()
+    for _, t := range s.tasks {
+        total.Merge(t.counters)
+    }
+    return total
+}
+
+// fraction is how much of the task is done. The caller holds the job lock.
+func (t *TaskStatus) fraction() float64 {
+    switch t.State {
+    case TaskDone:
+        return 1
+    case TaskRunning:
+        return t.progress.Fraction()
+    }
+    return 0
+}
+
+// Progress is the fraction of the whole job done, counting the map and
+// reduce phases as half each, and an estimate of the time left.
+func (s *JobStatus) Progress() (float64, time.Duration) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.progress()
+}
+
+func (s *JobStatus) progress() (float64, time.Duration) {
+    var mapDone, reduceDone float64
+    for _, t := range s.tasks {
+        switch t.Phase {
+        case "map":
+            mapDone += t.fraction()
+        case "reduce":
+            reduceDone += t.fraction()
+        }
+    }
+    var fraction float64
+    if s.M > 0 {
+        fraction += mapDone / float64(s.M) / 2
+    }
+    if s.R > 0 {
+        fraction += reduceDone / float64(s.R) / 2
+    }
+    if !s.Finished.IsZero() {
+        return 1, 0
+    }
+    return fraction, estimateRemaining(time.Since(s.Started), fraction)
+}
+
+// Finish marks the task done, or failed when err is not nil.
+func (t *TaskStatus) Finish(err error) {
+    t.job.mu.Lock()
+    defer t.job.mu.Unlock()
+    t.Finished = time.Now()
+    t.State = TaskDone
+    if err != nil {
+        t.State = TaskFailed
+        t.Err = err.Error()
+        t.Failures++
+    }
+}
+
+type taskView struct {
+    Phase       string              `json:"phase"`
+    N           int                 `json:"n"`
+    Host        string              `json:"host"`
+    State       TaskState           `json:"state"`
+    Started     time.Time           `json:"started"`
+    Finished    time.Time           `json:"finished"`
+    Elapsed     string              `json:"elapsed"`
+    Progress    float64             `json:"progress"`
+    Error       string              `json:"error,omitempty"`
+    Shuffled    int64               `json:"bytes_shuffled"`
+    Counters    map[string]int64    `json:"counters"`
+}
+
+type jobView struct {
+    ID          string              `json:"id"`
+    M           int                 `json:"m"`
+    R           int                 `json:"r"`
+    Source      string              `json:"source"`
+    Output      string              `json:"output"`
+    CacheFiles  []string            `json:"cache_files,omitempty"`
+    Phase       string              `json:"phase"`
+    Reason      string              `json:"reason,omitempty"`
+    Blacklisted map[string]string   `json:"blacklisted,omitempty"`
+    Started     time.Time           `json:"started"`
+    Elapsed     string              `json:"elapsed"`
+    Progress    float64             `json:"progress"`
+    ETA         string              `json:"eta"`
+    Shuffled    int64               `json:"bytes_shuffled"`
+    Counters    map[string]int64    `json:"counters"`
+    Tasks       []taskView          `json:"tasks"`
+}
+
+func elapsed(start, end time.Time) string {
+    if start.IsZero() {
+        return ""
+    }
+    if end.IsZero() {
+        end = time.Now()
+    }
+    return end.Sub(start).Round(time.Millisecond).String()
+}
+
+// view copies the job state so it can be rendered without holding the lock.
+func (s *JobStatus) view() jobView {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    v := jobView{
+        ID: s.ID, M: s.M, R: s.R, Source: s.Source, Output: s.Output, CacheFiles: s.CacheFiles,
+        Phase: s.Phase, Reason: s.Reason, Started: s.Started, Elapsed: elapsed(s.Started, s.Finished),
+    }
+    if len(s.Blacklisted) > 0 {
+        v.Blacklisted = make(map[string]string)
+        for worker, reason := range s.Blacklisted {
+            v.Blacklisted[worker] = reason
+        }
+    }
+    total := NewCounters()
+    for _, t := range s.tasks {
+        total.Merge(t.counters)
+        v.Tasks = append(v.Tasks, taskView{
+            Phase: t.Phase, N: t.N, Host: t.Host, State: t.State,
+            Started: t.Started, Finished: t.Finished, Elapsed: elapsed(t.Started, t.Finished),
+            Progress: t.fraction(), Error: t.Err, Shuffled: t.counters.Get(CounterShuffleBytes), Counters: t.counters.Snapshot(),
+        })
+    }
+    fraction, eta := s.progress()
+    v.Progress = fraction
+    v.ETA = eta.Round(time.Second).String()
+    v.Shuffled = total.Get(CounterShuffleBytes)
+    v.Counters = total.Snapshot()
+    return v
+}
+
+func percent(f float64) string {return fmt.Sprintf("%.1f%%", f*100)}
+
+var statusPage = template.Must(template.New("status").Funcs(template.FuncMap{"percent": percent}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta http-equiv="refresh" content="2">
+<title>{{.ID}}: {{.Phase}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+.failed { color: #b00; }
+.running { color: #06c; }
+</style>
+</head>
+<body>
+<h1>{{.ID}}: {{.Phase}}</h1>
+{{if .Reason}}<p class="failed">{{.Reason}}</p>
+{{end}}<p>{{.Source}} &rarr; {{.Output}}, M={{.M}}, R={{.R}}{{if .CacheFiles}}, cache: {{range .CacheFiles}}{{.}} {{end}}{{end}}</p>
+<p>Started {{.Started.Format "15:04:05"}}, elapsed {{.Elapsed}}, {{.Shuffled}} bytes shuffled</p>
+<p><progress value="{{.Progress}}" max="1"></progress> {{percent .Progress}} done, about {{.ETA}} left</p>
+<h2>Tasks</h2>
+<table>
+<tr><th>Phase</th><th>Task</th><th>Host</th><th>State</th><th>Progress</th><th>Elapsed</th><th>Bytes shuffled</th><th>Error</th></tr>
+{{range .Tasks}}<tr class="{{.State}}"><td>{{.Phase}}</td><td>{{.N}}</td><td>{{.Host}}</td><td>{{.State}}</td><td>{{percent .Progress}}</td><td>{{.Elapsed}}</td><td>{{.Shuffled}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+{{if .Blacklisted}}<h2>Blacklisted workers</h2>
+<table>
+{{range $worker, $reason := .Blacklisted}}<tr><td>{{$worker}}</td><td>{{$reason}}</td></tr>
+{{end}}</table>
+{{end}}<h2>Counters</h2>
+<table>
+{{range $name, $value := .Counters}}<tr><td>{{$name}}</td><td>{{$value}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// ServeHTTP renders the status page, or the same data as JSON when the
+// request path ends in .json.
+func (s *JobStatus) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+    v := s.view()
+    if strings.HasSuffix(req.URL.Path, ".json") {
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(v)
+        return
+    }
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    statusPage.Execute(w, v)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Storage is where a job's files live: the splits of its input, the files
+// map tasks write and reduce tasks read, its side files and the reduce
+// outputs. Names are slash-separated and relative to the root of the store.
+// SQLite only works on local files, so tasks fetch what they read into a
+// local directory and publish what they write from one.
+type Storage interface {
+    Open(name string) (io.ReadCloser, error)
+    Create(name string) (io.WriteCloser, error)
+    List(prefix string) ([]string, error)
+    Remove(name string) error
+    Rename(from, to string) error
+
+    // URL is where the file can be fetched from by someone without the
+    // Storage, for logs and for handing out.
+    URL(name string) string
+}
+
+var ErrReadOnly = errors.New("storage is read-only")
+
+// LocalStorage keeps files in a directory. When Host is set the directory
+// is assumed to be served at /data/ there, which is what URL points at.
+type LocalStorage struct {
+    Dir     string
+    Host    string
+}
+
+func (s *LocalStorage) Path(name string) string {return filepath.Join(s.Dir, filepath.FromSlash(name))}
+
+func (s *LocalStorage) Open(name string) (io.ReadCloser, error) {return os.Open(s.Path(name))}
+
+func (s *LocalStorage) Create(name string) (io.WriteCloser, error) {
+    if err := os.MkdirAll(filepath.Dir(s.Path(name)), 0755); err != nil {
+        return nil, err
+    }
+    return os.Create(s.Path(name))
+}
+
+func (s *LocalStorage) List(prefix string) ([]string, error) {
+    var names []string
+    err := filepath.Walk(s.Dir, func(path string, info os.FileInfo, err error) error {
+        if err != nil || info.IsDir() {
+            return err
+        }
+        rel, err := filepath.Rel(s.Dir, path)
+        if err != nil {
+            return err
+        }
+        if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+            names = append(names, name)
+        }
+        return nil
+    })
+    return names, err
+}
+
+func (s *LocalStorage) Remove(name string) error {return os.Remove(s.Path(name))}
+
+func (s *LocalStorage) Rename(from, to string) error {return os.Rename(s.Path(from), s.Path(to))}
+
+func (s *LocalStorage) URL(name string) string {
+    if s.Host != "" {
+        return makeURL(s.Host, name)
+    }
+    return "file://" + filepath.ToSlash(s.Path(name))
+}
+
+// HTTPStorage reads the files another process serves at /data/ on Host. It
+// cannot change them. A failed request, or a transfer cut off part way, is
+// retried up to Retries times (4 when 0) after a backoff that starts at
+// Backoff (500ms when 0) and doubles; see download.go.
+type HTTPStorage struct {
+    Host    string
+    Client  *http.Client
+    Retries int
+    Backoff time.Duration
+}
+
+func (s *HTTPStorage) client() *http.Client {
+    if s.Client != nil {
+        return s.Client
+    }
+    return shuffleClient()
+}
+
+func (s *HTTPStorage) Create(name string) (io.WriteCloser, error) {return nil, ErrReadOnly}
+
+func (s *HTTPStorage) List(prefix string) ([]string, error) {return nil, ErrReadOnly}
+
+func (s *HTTPStorage) Remove(name string) error {return ErrReadOnly}
+
+func (s *HTTPStorage) Rename(from, to string) error {return ErrReadOnly}
+
+func (s *HTTPStorage) URL(name string) string {return makeURL(s.Host, name)}
+
+// MemoryStorage keeps files in memory. A file created in it appears, whole,
+// when its writer is closed.
+type MemoryStorage struct {
+    mu      sync.Mutex
+    files   map[string][]byte
+}
+
+func NewMemoryStorage() *MemoryStorage {
+    return &MemoryStorage{files: make(map[string][]byte)}
+}
+
+func (s *MemoryStorage) Open(name string) (io.ReadCloser, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    data, ok := s.files[name]
+    if !ok {
+        return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+    }
+    return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+type memoryFile struct {
+    bytes.Buffer
+    name    string
+    store   *MemoryStorage
+}
+
+func (f *memoryFile) Close() error {
+    f.store.mu.Lock()
+    defer f.store.mu.Unlock()
+    f.store.files[f.name] = f.Bytes()
+    return nil
+}
+
+func (s *MemoryStorage) Create(name string) (io.WriteCloser, error) {
+    return &memoryFile{name: name, store: s}, nil
+}
+
+func (s *MemoryStorage) List(prefix string) ([]string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var names []string
+    for name := range s.files {
+        if strings.HasPrefix(name, prefix) {
+            names = append(names, name)
+        }
+    }
+    sort.Strings(names)
+    return names, nil
+}
+
+func (s *MemoryStorage) Remove(name string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, ok := s.files[name]; !ok {
+        return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+    }
+    delete(s.files, name)
+    return nil
+}
+
+func (s *MemoryStorage) Rename(from, to string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    data, ok := s.files[from]
+    if !ok {
+        return &os.PathError{Op: "rename", Path: from, Err: os.ErrNotExist}
+    }
+    delete(s.files, from)
+    s.files[to] = data
+    return nil
+}
+
+func (s *MemoryStorage) URL(name string) string {return "mem://" + name}
+
+// storageFor is the store a task reads from: the one it was given, or else
+// what host serves over HTTP.
+func storageFor(store Storage, host string) Storage {
+    if store != nil {
+        return store
+    }
+    return &HTTPStorage{Host: host}
+}
+
+// fetch makes the named file available at a local path, copying it to path
+// unless the store already keeps it on local disk, and returns where it is.
+func fetch(store Storage, name, path string) (string, error) {
+    if local, ok := store.(*LocalStorage); ok {
+        _, err := os.Stat(local.Path(name))
+        return local.Path(name), err
+    }
+    in, err := store.Open(name)
+    if err != nil {
+        return path, err
+    }
+    defer in.Close()
+    out, err := os.Create(path)
+    if err != nil {
+        return path, err
+    }
+    if _, err := io.Copy(out, in); err != nil {
+        out.Close()
+        return path, fmt.Errorf("fetching %s: %v", redactURL(store.URL(name)), err)
+    }
+    return path, out.Close()
+}
+
+// fetchAll fetches each named file into dir, verifying those checksums
+// has an entry for. On failure the paths returned are those of the files
+// before the one that failed.
+func fetchAll(store Storage, names []string, dir string, checksums map[string]string) ([]string, error) {
+    var paths []string
+    for _, name := range names {
+        path, err := fetchVerified(store, name, filepath.Join(dir, filepath.Base(name)), checksums[name])
+        if err != nil {
+            return paths, err
+        }
+        paths = append(paths, path)
+    }
+    return paths, nil
+}
+
+// publish moves the local file at path into the store under name. A local
+// store on the same file system gets it by rename, so a file under its
+// final name is always whole.
+func publish(store Storage, path, name string) error {
+    if local, ok := store.(*LocalStorage); ok {
+        if err := os.MkdirAll(filepath.Dir(local.Path(name)), 0755); err != nil {
+            return err
+        }
+        if err := os.Rename(path, local.Path(name)); err == nil {
+            return nil
+        }
+    }
+    in, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+    out, err := store.Create(name)
+    if err != nil {
+        return err
+    }
+    if _, err := io.Copy(out, in); err != nil {
+        out.Close()
+        return fmt.Errorf("publishing %s: %v", redactURL(store.URL(name)), err)
+    }
+    if err := out.Close(); err != nil {
+        return err
+    }
+    return os.Remove(path)
+}
+
+// exists reports whether every named file is in the store.
+func exists(store Storage, names []string) bool {
+    for _, name := range names {
+        f, err := store.Open(name)
+        if err != nil {
+            return false
+        }
+        f.Close()
+    }
+    return true
+}
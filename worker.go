@@ -4,19 +4,20 @@ import (
     "database/sql"
     _ "github.com/mattn/go-sqlite3"
     "strings"
-    "log"
     "os"
-    "io"
     "io/fs"
     "path/filepath"
     "fmt"
+    "io"
+    "net"
     "net/http"
-    "net/url"
     "hash/fnv"
     "unicode"
     "strconv"
     "runtime"
-    "math"
+    "flag"
+    "crypto/tls"
+    "time"
 )
 
 const (
@@ -26,12 +27,74 @@ type MapTask struct {
     M, R        int
     N           int
     SourceHost  string
+    Inputs      []MapInput
+    CacheHost   string
+    CacheFiles  []string
+    Counters    *Counters       `json:"-"`
+    Progress    *TaskProgress   `json:"-"`
+    JobID       string
+    Attempt     int
+    OutputDir   string
+
+    // Store is where the task reads its splits and side files, and falls
+    // back to what SourceHost serves over HTTP when nil.
+    Store       Storage         `json:"-"`
+
+    // SkipBadRecords runs the task in skipping mode (see skip.go), failing
+    // it only once more than MaxSkippedRecords records were skipped.
+    SkipBadRecords      bool
+    MaxSkippedRecords   int64
+
+    // Codec, when set, compresses the task's output files, which then end
+    // in its extension. Format is FormatSQLite or FormatRecords.
+    Codec       Codec           `json:"-"`
+    Format      string
+
+    // Checksums are those of the source splits and cache files, by name,
+    // as the coordinator recorded them.
+    Checksums   map[string]string
+}
+
+// MapInput is one tagged source of a MapTask. Every value emitted by its
+// Mapper is prefixed with Tag so a reducer can tell the datasets apart.
+// A nil Mapper falls back to the one registered as MapperName, and without
+// a name to the client passed to Process. Only a name reaches a worker
+// process.
+type MapInput struct {
+    Tag         string
+    SourceHost  string
+    Mapper      Mapper          `json:"-"`
+    MapperName  string
 }
 
 type ReduceTask struct {
     M, R        int
     N           int
     SourceHosts  []string
+    CacheHost   string
+    CacheFiles  []string
+    Counters    *Counters       `json:"-"`
+    Progress    *TaskProgress   `json:"-"`
+    JobID       string
+    Attempt     int
+    OutputDir   string
+    Store       Storage         `json:"-"`
+    SkipMaps    map[int]bool
+
+    // Parallel is how many key groups are reduced at once. With
+    // OrderedOutput set they are still written in key order.
+    Parallel        int
+    OrderedOutput   bool
+
+    SkipBadRecords      bool
+    MaxSkippedRecords   int64
+
+    // Codec and Format are what the map output files were written with.
+    // Checksums are theirs, by name, as committed, along with those of
+    // the cache files.
+    Codec       Codec           `json:"-"`
+    Format      string
+    Checksums   map[string]string
 }
 
 type Pair struct {
@@ -39,19 +102,45 @@ type Pair struct {
     Value   string
 }
 
+type Mapper interface {
+    Map(key, value string, output chan<- Pair) error
+}
+
 type Interface interface {
     Map(key, value string, output chan<- Pair) error
     Reduce(key string, values <-chan string, output chan<- Pair) error
 }
 
-func mapSourceFile(m int) string {return fmt.Sprintf("map_%d_source.db", m)}
-func mapInputFile(m int) string {return fmt.Sprintf("map_%d_input.db", m)}
-func mapOutputFile(m, r int) string {return fmt.Sprintf("map_%d_output_%d.db", m, r)}
-func reduceInputFile(r int) string {return fmt.Sprintf("reduce_%d_input.db", r)}
-func reduceOutputFile(r int) string {return fmt.Sprintf("reduce_%d_output.db", r)}
-func reducePartialFile(r int) string {return fmt.Sprintf("reduce_%d_partial.db", r)}
-func reduceTempFile(r int) string {return fmt.Sprintf("reduce_%d_temp.db", r)}
-func makeURL(host, file string) string {return fmt.Sprintf("http://%s/data/%s", host, file)}
+// Every intermediate file starts with the ID of its job, so one data
+// directory and one /data/ server can hold any number of jobs at once.
+func mapSourcePattern(job string) string {return job + "_map_%d_source.db"}
+func mapSourceFile(job string, m int) string {return fmt.Sprintf(mapSourcePattern(job), m)}
+func mapInputFile(job string, m int) string {return fmt.Sprintf("%s_map_%d_input.db", job, m)}
+func mapTaggedSourcePattern(job, tag string) string {return job + "_map_%d_source_" + tag + ".db"}
+func mapTaggedSourceFile(job, tag string, m int) string {return fmt.Sprintf(mapTaggedSourcePattern(job, tag), m)}
+func mapTaggedInputFile(job, tag string, m int) string {return fmt.Sprintf("%s_map_%d_input_%s.db", job, m, tag)}
+func mapOutputFile(job string, m, r int) string {return fmt.Sprintf("%s_map_%d_output_%d.db", job, m, r)}
+func reduceInputFile(job string, r int) string {return fmt.Sprintf("%s_reduce_%d_input.db", job, r)}
+func reduceOutputFile(job string, r int) string {return fmt.Sprintf("%s_reduce_%d_output.db", job, r)}
+func reducePartialFile(job string, r int) string {return fmt.Sprintf("%s_reduce_%d_partial.db", job, r)}
+func reduceTempFile(job string, r int) string {return fmt.Sprintf("%s_reduce_%d_temp.db", job, r)}
+
+// mapSplitFiles are the source splits map task m reads: one per input tag,
+// or the untagged one when there are no tags.
+func mapSplitFiles(job string, tags []string, m int) []string {
+    if len(tags) == 0 {
+        return []string{mapSourceFile(job, m)}
+    }
+    var names []string
+    for _, tag := range tags {
+        names = append(names, mapTaggedSourceFile(job, tag, m))
+    }
+    return names
+}
+
+// makeURL is where host serves file: over https once TLS is set up, and
+// signed when the file's job signs its URLs (see secure.go).
+func makeURL(host, file string) string {return signURL(fmt.Sprintf("%s://%s/data/%s", shuffleScheme(), host, file), file)}
 
 func openDatabase(path string) (*sql.DB, error) {
     options :=
@@ -75,24 +164,30 @@ func createDatabase(path string) (*sql.DB, error) {
             "&" + "_locking_mode=NORMAL" +
             "&" + "mode=rw" +
             "&" + "_synchronous=OFF"
-    if _, err := os.Create(path); err != nil {
-        log.Fatalf("creating database file: %v", err)
+    f, err := os.Create(path)
+    if err != nil {
+        return nil, fmt.Errorf("creating database file: %v", err)
     }
+    f.Close()
     db, err := sql.Open("sqlite3", path+options)
-    tx, errr := db.Begin()
-    if errr != nil {
-        log.Fatalf("beginning table create tx: %v", errr)
+    if err != nil {
+        return nil, err
     }
-    _, errr = tx.Exec("CREATE TABLE pairs(key text, value text)")
-    if errr != nil {
-        log.Fatalf("creating pairs table: %v", errr)
+    tx, err := db.Begin()
+    if err != nil {
+        db.Close()
+        return nil, fmt.Errorf("beginning table create tx: %v", err)
     }
-    tx.Commit()
-    return db, err
+    _, err = tx.Exec("CREATE TABLE pairs(key text, value text)")
+    if err != nil {
+        tx.Rollback()
+        db.Close()
+        return nil, fmt.Errorf("creating pairs table: %v", err)
+    }
+    return db, tx.Commit()
 }
 
 func splitDatabase(source, outputDir, outputPattern string, m int) ([]string, error) {
-    fmt.Printf("splitting %s into %d new files in %s\n", source, m, outputDir)
     var names []string
     var err error
     db, err := openDatabase(source)
@@ -108,7 +203,7 @@ func splitDatabase(source, outputDir, outputPattern string, m int) ([]string, er
     if err != nil {return names, err}
     var splits []*sql.DB
     if err != nil {
-        log.Fatalf("opening database for splitting: %v", err)
+        return names, fmt.Errorf("opening database for splitting: %v", err)
     }
     rows, err := db.Query("SELECT key, value FROM pairs")
     for i := 0; i < m; i++ {
@@ -141,143 +236,234 @@ func splitDatabase(source, outputDir, outputPattern string, m int) ([]string, er
 }
 
 
-func mergeDatabases(urls []string, path, temp string) (*sql.DB, error) {
-    //fmt.Printf("downloading %d files from %s into %s and merging them into new file %s\n", len(urls), temp, temp, path)
+// mergeDatabases creates a database at path holding the pairs of every
+// database in paths. The inputs stay put: a retried or backup attempt may
+// need them.
+func mergeDatabases(paths []string, path string) (*sql.DB, error) {
     db, err := createDatabase(path)
-    for _, u := range urls {
-        // DOWNLOAD
-        file, err := url.Parse(u) // EXTRACT THE URL OBJECT
-        filename := file.Path // GET THE ACTUAL FILENAME
-        s := strings.Split(filename, "/")
-        filename = s[len(s)-1]
-        p := filepath.Join(temp, filename)
-        // DOWNLOADING FROM THE SAME LOCATION REPLACES THE FILE; DATA IS LOST
-        /*f, err := os.Create(p)
-        if err != nil {
+    if err != nil {
+        return nil, err
+    }
+    for _, p := range paths {
+        if _, err := db.Exec("attach ? as merge; insert into pairs select * from merge.pairs; detach merge", p); err != nil {
             return db, err
         }
-        defer f.Close()
-        resp, err := http.Get(u) // GET REQUEST TO SERVER
-        _, err = io.Copy(f, resp.Body) // COPY THE RESPONSE BODY TO THE NEW FILE
-        resp.Body.Close()
-        if err != nil {
-            return db, err
-        }*/
-        // MERGE
-        _, err = db.Exec("attach ? as merge; insert into pairs select * from merge.pairs; detach merge", p)
-        if err != nil {
-            return db, err
+    }
+    return db, nil
+}
+
+// Process runs the map task. Source splits and side files come from
+// task.Store; copies of them, when the store is not local, and the task's
+// output go to task.OutputDir, or tempdir when that is empty.
+func (task *MapTask) Process(tempdir string, client Interface) (err error) {
+    done := trackTask("map")
+    defer func() { done(err) }()
+    log := task.taskLogger()
+    outdir := task.OutputDir
+    if outdir == "" {
+        outdir = tempdir
+    }
+    inputs := task.Inputs
+    if len(inputs) == 0 {
+        inputs = []MapInput{{SourceHost: task.SourceHost}}
+    }
+    outputs := make(map[string]pairWriter)
+    defer func() {
+        for _, w := range outputs {
+            w.Close()
+        }
+    }()
+    for r := 0; r < task.R; r++ {
+        filename := task.outputFile(r)
+        var w pairWriter
+        var err error
+        if task.Format == FormatRecords {
+            w, err = CreateRecordFile(filepath.Join(outdir, filename), true, false)
+        } else {
+            w, err = createSQLWriter(filepath.Join(outdir, filename))
         }
-        // DELETE
-        /*
-        parts := strings.Split(u, "/")
-        err = os.Remove(filepath.Join(temp, parts[len(parts)-1]))
         if err != nil {
-            return db, err
-        }*/
-        err = os.Remove(p)
+            return err
+        }
+        outputs[filename] = w
+    }
+    if task.Counters == nil {
+        task.Counters = NewCounters()
+    }
+    ctx := &TaskContext{Phase: "map", N: task.N, Counters: task.Counters, Log: log}
+    if len(task.CacheFiles) > 0 {
+        cache, err := loadCache(storageFor(task.Store, task.CacheHost), task.JobID, task.CacheFiles, task.Checksums, tempdir)
         if err != nil {
-            return db, err
+            return err
         }
+        ctx.Cache = cache
     }
-    return db, err
-}
-
 
-func download_map_input_file(n int, source, input, tempdir string) (string, error) {
-    path := filepath.Join(tempdir, input)
-    f, err := os.Create(path)
-    if err != nil {
-        return path, err
+    var quarantine *Quarantine
+    if task.SkipBadRecords {
+        log.Info("skipping bad records")
+        quarantine = newQuarantine(outdir, task.JobID, "map", task.N, task.Attempt)
+        defer quarantine.Close()
     }
-    defer f.Close()
-    resp, err := http.Get(source)
-    if err != nil {
-        return path, err
+    var record int64
+    for _, input := range inputs {
+        var mapper Mapper = client
+        switch {
+        case input.Mapper != nil:
+            mapper = input.Mapper
+        case input.MapperName != "":
+            if mapper, err = MapperByName(input.MapperName); err != nil {
+                return err
+            }
+        }
+        if err = task.processInput(ctx, outdir, input, mapper, outputs, quarantine, &record); err != nil {
+            return err
+        }
     }
-    _, err = io.Copy(f, resp.Body)
-    if err != nil {
-        return path, err
+    for filename, w := range outputs {
+        if err := w.Close(); err != nil {
+            return fmt.Errorf("closing %s: %v", filename, err)
+        }
+        if _, err := compressFile(filepath.Join(outdir, filename), task.Codec); err != nil {
+            return err
+        }
     }
-    resp.Body.Close()
-    return path, err
+    log.Info("task done")
+    return err
+}
+
+// outputFile is the name of the task's output for partition r.
+func (task *MapTask) outputFile(r int) string {
+    return intermediateFile(mapOutputFile(task.JobID, task.N, r), task.Format)
+}
+
+func (task *MapTask) taskLogger() *Logger {
+    return logger.With("job", task.JobID, "phase", "map", "task", task.N, "attempt", task.Attempt)
 }
 
-func (task *MapTask) Process(tempdir string, client Interface, is_routine bool, used_routines *int) error {
-    u := makeURL(task.SourceHost, mapSourceFile(task.N))
-    path, err := download_map_input_file(task.N, u, mapInputFile(task.N), tempdir)
+// processInput fetches one source split and runs every row of it through
+// mapper, tagging the emitted values when the input has a tag.
+func (task *MapTask) processInput(ctx *TaskContext, outdir string, input MapInput, mapper Mapper, outputs map[string]pairWriter, quarantine *Quarantine, record *int64) error {
+    source, inputFile := mapSourceFile(task.JobID, task.N), mapInputFile(task.JobID, task.N)
+    if input.Tag != "" {
+        source, inputFile = mapTaggedSourceFile(task.JobID, input.Tag, task.N), mapTaggedInputFile(task.JobID, input.Tag, task.N)
+    }
+    path, err := fetchVerified(storageFor(task.Store, input.SourceHost), source, filepath.Join(outdir, inputFile), task.Checksums[source])
     if err != nil {
         return err
     }
+    if info, err := os.Stat(path); err == nil {
+        task.Counters.Increment(CounterMapInputBytes, info.Size())
+    }
     db, err := openDatabase(path)
     if err != nil {
         return err
     }
-    statements := make(map[string]*sql.Stmt)
-    for r := 0; r < task.R; r++ {
-        filename := mapOutputFile(task.N, r)
-        out_db, err := createDatabase(filepath.Join(tempdir, filename))
-        _, _ = out_db.Exec("CREATE TABLE pairs(key text, value text)")
-        if err != nil {
-            return err
-        }
-        statements[filename], err = out_db.Prepare("INSERT INTO pairs VALUES(?, ?)")
-        if err != nil {
-            return err
-        }
-        defer statements[filename].Close()
+    defer db.Close()
+    var rows int64
+    if err := db.QueryRow("SELECT count(*) FROM pairs").Scan(&rows); err == nil {
+        task.Progress.AddTotal(rows)
     }
     pairs, err := db.Query("SELECT key, value FROM pairs")
     if err != nil {
         return err
     }
+    defer pairs.Close()
 
     for pairs.Next() {
         var k, v string
         pairs.Scan(&k, &v)
         pair := Pair{Key: k, Value: v}
+        task.Counters.Increment(CounterMapInputRecords, 1)
+        metricRecordsRead.Inc("map")
+        *record++
+        if quarantine != nil {
+            if err := task.skipMap(ctx, mapper, input.Tag, *record, pair, quarantine, outputs); err != nil {
+                return err
+            }
+            task.Progress.Advance(1)
+            continue
+        }
         output := make(chan Pair, 100)
         finishedMap := make(chan error)
-        go task.writeOutput(output, finishedMap, tempdir, statements)
-        if err := client.Map(pair.Key, pair.Value, output); err != nil {
-            return fmt.Errorf("Issue with client map: %v", err)
+        go task.writeOutput(output, finishedMap, outputs)
+        mapped := output
+        if input.Tag != "" {
+            mapped = make(chan Pair, 100)
+            go tagOutput(input.Tag, mapped, output)
+        }
+        err := runMap(ctx, mapper, pair.Key, pair.Value, mapped)
+        // The mapper should have closed its output, but may have failed
+        // before it could.
+        closeQuietly(mapped)
+        finished := <-finishedMap
+        if err != nil {
+            return &UserError{Phase: "map", Record: *record, Key: pair.Key, Err: err}
         }
-        if err := <-finishedMap; err != nil {
+        if err := finished; err != nil {
             return fmt.Errorf("Issue writing output: %v", err)
         }
+        task.Progress.Advance(1)
     }
-    db.Close()
-    if is_routine == true {
-        *used_routines -= 1;
-        fmt.Printf("task %d is done and there are now %d used goroutines\n", task.N, *used_routines)
-    } else {
-        fmt.Printf("task %d is done but did not use a goroutine\n", task.N)
-    }
-    return err
+    return pairs.Err()
 }
 
-type KeySet struct {
-  Key string
-  Input *chan string
-}
 
+// Process runs the reduce task over partition N of the output of every map
+// task, so that all the values of a key meet in one task. Its merged input
+// and output go to task.OutputDir, or tempdir when that is empty.
+func (task *ReduceTask) Process(tempdir string, client Interface) (err error) {
+    done := trackTask("reduce")
+    defer func() { done(err) }()
+    log := task.taskLogger()
+    outdir := task.OutputDir
+    if outdir == "" {
+        outdir = tempdir
+    }
 
-func (task *ReduceTask) Process(tempdir string, client Interface, is_routine bool, used_routines *int, first, last float64) error {
+    // the map output files this task reads, and the map task each is from
+    var names []string
+    var producers []int
+    for i := 0; i < task.M; i++ {
+        if task.SkipMaps[i] {
+            continue
+        }
+        names = append(names, intermediateFile(mapOutputFile(task.JobID, i, task.N), task.Format))
+        producers = append(producers, i)
+    }
+
+    if task.Counters == nil {
+        task.Counters = NewCounters()
+    }
+    ctx := &TaskContext{Phase: "reduce", N: task.N, Counters: task.Counters, Log: log}
+    if len(task.CacheFiles) > 0 {
+        cache, err := loadCache(storageFor(task.Store, task.CacheHost), task.JobID, task.CacheFiles, task.Checksums, tempdir)
+        if err != nil {
+            return err
+        }
+        ctx.Cache = cache
+    }
 
-    // stores map output files into a slice of strings
-    var urls []string
-    for i := int(first); i <= int(last); i++ {
-        for j := 0; j < 3; j++ {
-            urls = append(urls, makeURL(task.SourceHosts[0], mapOutputFile(i, j)))
+    paths, fetched, err := fetchCompressed(storageFor(task.Store, task.SourceHosts[0]), names, task.Codec, outdir, task.Checksums)
+    task.Counters.Increment(CounterShuffleBytes, fetched)
+    metricShuffleBytes.Add("", float64(fetched))
+    if err != nil {
+        // Tell the coordinator whose output could not be had, so it can
+        // decide whether to have it made again.
+        if len(paths) < len(names) {
+            return &MapOutputError{Map: producers[len(paths)], Err: err}
         }
-    } 
+        return fmt.Errorf("issue fetching map output: %v", err)
+    }
 
-    inputDB, err := mergeDatabases(urls, filepath.Join(tempdir, reduceInputFile(task.N)), tempdir)
+    input, keys, err := task.openInput(paths, outdir)
     if err != nil {
-        log.Fatalf("issue merging: %v", err)
+        return err
     }
+    defer input.Close()
+    task.Progress.AddTotal(keys)
 
-    outputDB, err := createDatabase(filepath.Join(tempdir, reduceOutputFile(task.N)))
+    outputDB, err := createDatabase(filepath.Join(outdir, reduceOutputFile(task.JobID, task.N)))
     if err != nil {
         return fmt.Errorf("issue creating output database: %v", err)
     }
@@ -288,168 +474,512 @@ func (task *ReduceTask) Process(tempdir string, client Interface, is_routine boo
     }
     defer outputStatements.Close()
 
-    rows, err := inputDB.Query("SELECT key, value FROM pairs ORDER BY key, value DESC")
-    if err != nil {
-        return fmt.Errorf("issue querying input db: %v", err)
+    if task.SkipBadRecords {
+        log.Info("skipping bad records")
+        quarantine := newQuarantine(outdir, task.JobID, "reduce", task.N, task.Attempt)
+        defer quarantine.Close()
+        err := task.skipReduce(ctx, client, input, outputStatements, quarantine, filepath.Join(outdir, skipSpillFile(task.JobID, task.N)))
+        outputDB.Close()
+        if err != nil {
+            return err
+        }
+        log.Info("task done")
+        return nil
     }
-    inputDB.Close()
-    defer rows.Close()
 
-    i := 0
+    executor := newReduceExecutor(task, ctx, client, outputStatements, task.Parallel, task.OrderedOutput)
     var previous string
-    KeySets := make(chan KeySet, 100)
-    var currentSet KeySet
-    for rows.Next() {
-        var k, v string
-        rows.Scan(&k, &v)
-        pair := Pair{Key: k, Value: v}
-        
-        if previous != pair.Key {
-            output := make(chan Pair, 100)
-            finishedReduce := make(chan error)
-            if i != 0 {
-                set := <-KeySets
-                close(*set.Input)
-                for len(finishedReduce) > 0 {
-                    err := <-finishedReduce
-                    if err != nil {
-                        return fmt.Errorf("issue writing reduce output\n")
-                    }
-                }
+    started := false
+    var readErr error
+    for !executor.Failed() {
+        pair, err := input.Next()
+        if err != nil {
+            if err != io.EOF {
+                readErr = err
             }
-            
-            input := make(chan string, 100)
-            KeySets <- KeySet{Key: pair.Key, Input: &input}
-            currentSet = KeySet{Key: pair.Key, Input: &input}
-            
-            
-            go task.writeOutput(output, finishedReduce, outputStatements)
-            go client.Reduce(pair.Key, *currentSet.Input, output)
-        }
-        previous = pair.Key
-        *currentSet.Input <- pair.Value
-        i++
-    }
-    set := <-KeySets
-    close(*set.Input)
+            break
+        }
+        k, v := pair.Key, pair.Value
+        task.Counters.Increment(CounterReduceInputRecords, 1)
+        metricRecordsRead.Inc("reduce")
+        if !started || previous != k {
+            task.Counters.Increment(CounterReduceInputGroups, 1)
+            executor.Start(k)
+            started = true
+        }
+        previous = k
+        executor.Add(v)
+    }
+    err = executor.Close()
     outputDB.Close()
-
-    if is_routine == true {
-    *used_routines -= 1;
-    fmt.Printf("task %d is done and there are now %d used goroutines\n", task.N, *used_routines)
-    } else {
-    fmt.Printf("task %d is done but did not use a goroutine\n", task.N)
+    if err != nil {
+        return err
+    }
+    if readErr != nil {
+        return fmt.Errorf("issue reading reduce input: %v", readErr)
     }
 
+    log.Info("task done")
     return nil
 }
 
-func (task *MapTask) writeOutput(output chan Pair, finishedMap chan<- error, tempdir string, statements map[string]*sql.Stmt) {
+// openInput merges the fetched map outputs into the task's input, sorted
+// by key, and returns it with the number of distinct keys in it. For record
+// files the count is an upper bound.
+func (task *ReduceTask) openInput(paths []string, outdir string) (pairSource, int64, error) {
+    if task.Format == FormatRecords {
+        merger, keys, err := mergeRecordFiles(paths)
+        if err != nil {
+            return nil, 0, fmt.Errorf("issue merging: %v", err)
+        }
+        return merger, keys, nil
+    }
+    inputDB, err := mergeDatabases(paths, filepath.Join(outdir, reduceInputFile(task.JobID, task.N)))
+    if err != nil {
+        if inputDB != nil {
+            inputDB.Close()
+        }
+        return nil, 0, fmt.Errorf("issue merging: %v", err)
+    }
+    defer inputDB.Close()
+    var keys int64
+    inputDB.QueryRow("SELECT count(DISTINCT key) FROM pairs").Scan(&keys)
+    rows, err := inputDB.Query("SELECT key, value FROM pairs ORDER BY key, value DESC")
+    if err != nil {
+        return nil, 0, fmt.Errorf("issue querying input db: %v", err)
+    }
+    return rowSource{rows}, keys, nil
+}
+
+func (task *ReduceTask) taskLogger() *Logger {
+    return logger.With("job", task.JobID, "phase", "reduce", "task", task.N, "attempt", task.Attempt)
+}
+
+// writeOutput writes what a mapper emits into the partition its key hashes
+// to. After a failed write it drains output so the mapper does not block,
+// and reports the failure once output is closed.
+func (task *MapTask) writeOutput(output chan Pair, finishedMap chan<- error, outputs map[string]pairWriter) {
     for pair := range output {
       hash := fnv.New32()
       hash.Write([]byte(pair.Key))
       r := int(hash.Sum32() % uint32(task.R))
-      filename := mapOutputFile(task.N, r)
-      out_db, err := openDatabase(filepath.Join(tempdir, filename))
-      defer out_db.Close()
-      if err != nil {
-          finishedMap <- fmt.Errorf("cant open database for this reason: %v", err)
-          return
-      }
-      if _, err = statements[filename].Exec(pair.Key, pair.Value); err != nil {
+      start := time.Now()
+      if err := outputs[task.outputFile(r)].Write(pair.Key, pair.Value); err != nil {
+          for range output {
+          }
           finishedMap <- fmt.Errorf("issue inserting: %v", err)
           return
       }
+      metricInsertSeconds.ObserveSince(start)
+      task.Counters.Increment(CounterMapOutputRecords, 1)
+      metricRecordsEmitted.Inc("map")
     }
     finishedMap <- nil
 }
 
-func (task *ReduceTask) writeOutput(output <-chan Pair, finishedReduce chan<- error, stmt *sql.Stmt) {
-  for pair := range output {
-    if _, err := stmt.Exec(pair.Key, pair.Value); err != nil {
-      finishedReduce <- fmt.Errorf("issue inserting: %v", err)
-      return
-    }
-  }
-  finishedReduce <- nil
-}
-
 func main() {
+    cacheFlag := flag.String("cache", "", "comma-separated side files to ship to every worker")
+    historyFlag := flag.String("history", "", "directory to keep a copy of every job report in")
+    levelFlag := flag.String("log-level", "info", "lowest level to log: debug, info, warn or error")
+    jsonFlag := flag.Bool("log-json", false, "log one JSON object per line")
+    progressFlag := flag.Duration("progress", 5*time.Second, "how often to log job progress, 0 to never")
+    speculateFlag := flag.Bool("speculate", false, "run backup attempts of straggling tasks")
+    dataFlag := flag.String("data", filepath.Join(os.TempDir(), "data", "mapreduce"), "directory served at /data/ and shared by every job")
+    jobFlag := flag.String("job", "", "ID of the job, made up from the time and pid when empty; an unfinished job with the same ID is resumed")
+    var inputs InputList
+    flag.Var(&inputs, "input", "SQLite database to read pairs from, a local path or s3://bucket/key (default austen.db); repeat as tag=location to read tagged inputs, or tag:mapper=location to read one with a registered mapper (identity, swap or words)")
+    joinFlag := flag.String("join", "", "join the two tagged inputs on their keys: inner, left or full, the first -input being the left side")
+    outputFlag := flag.String("output", "result.db", "SQLite database to write results to, a local path or s3://bucket/key")
+    stateFlag := flag.String("state", "mapreduce_state.db", "SQLite database the coordinator journals finished tasks in, shared with standbys")
+    addressFlag := flag.String("address", "localhost:1337", "address to serve /data/ and the status page on while leading")
+    standbyFlag := flag.Bool("standby", false, "wait for the job's leader to stop renewing its lease, then take the job over")
+    leaseFlag := flag.Duration("lease", 10*time.Second, "how long the leader's lease lasts without being renewed")
+    attemptsFlag := flag.Int("max-attempts", 4, "times a task may fail before it is given up on")
+    backoffFlag := flag.Duration("backoff", time.Second, "wait before retrying a failed task, doubled on each further failure")
+    blacklistFlag := flag.Int("blacklist-after", 3, "failed attempts after which a worker gets no more, 0 to never blacklist")
+    mapFailuresFlag := flag.Float64("map-failures", 0, "percentage of map tasks that may fail without failing the job, 0 to fail fast")
+    skipFlag := flag.Bool("skip-bad-records", false, "once a task has failed, retry it skipping the records user code fails on")
+    skipAfterFlag := flag.Int("skip-after", 1, "failed attempts of a task before it is retried skipping bad records")
+    parallelFlag := flag.Int("reduce-parallel", 4, "key groups each reduce task reduces at once")
+    orderedFlag := flag.Bool("ordered", false, "write every reduce output in key order")
+    formatFlag := flag.String("intermediate", FormatSQLite, "format to keep map output in: "+FormatSQLite+" or "+FormatRecords)
+    fetchesFlag := flag.Int("fetches-per-host", 4, "files fetched from any one host at once")
+    fetchFailuresFlag := flag.Int("fetch-failures", 3, "failed fetches of a map task's output before the map task is run again")
+    tlsFlag := flag.Bool("tls", false, "serve /data/ and the status page over TLS with a certificate from the local CA")
+    tlsDirFlag := flag.String("tls-dir", filepath.Join(os.TempDir(), "mapreduce-ca"), "directory holding the local CA, created on first use and shared by the cluster")
+    directFlag := flag.Bool("direct-reads", false, "have tasks read job files from the data directory instead of fetching them from /data/")
+    workerFlag := flag.Bool("worker", false, "run as a worker process on -address, running the attempts coordinators send it; give it the coordinators' -data directory")
+    workersFlag := flag.String("workers", "", "comma-separated addresses of worker processes to run attempts on besides this one")
+    signFlag := flag.Bool("sign-urls", false, "sign the job's /data/ URLs and refuse requests without a valid signature")
+    compressFlag := flag.String("compress", "none", "codec to compress map output with: "+strings.Join(codecNames(), ", ")+" or none")
+    maxSkippedFlag := flag.Int64("max-skipped", 0, "bad records one task may skip before it fails anyway, 0 for no limit")
+    flag.Parse()
+    level, err := ParseLevel(*levelFlag)
+    if err != nil {
+        logger.Error("bad -log-level", "err", err)
+        os.Exit(2)
+    }
+    logger.Configure(os.Stderr, level, *jsonFlag)
+    MaxFetchesPerHost = *fetchesFlag
     runtime.GOMAXPROCS(1)
     var m = 9
     var r = 3
     os.Chmod(os.TempDir()+"/data", 0777)
-    tempdir := filepath.Join(os.TempDir()+"/data", fmt.Sprintf("mapreduce.%d", os.Getpid()))
-    os.RemoveAll(tempdir)
-    err := os.Mkdir(tempdir, fs.ModePerm)
+    tempdir := *dataFlag
+    if *workerFlag {
+        var tlsConfig *tls.Config
+        if *tlsFlag {
+            if tlsConfig, err = setupTLS(*tlsDirFlag, *addressFlag); err != nil {
+                logger.Error("setting up TLS", "dir", *tlsDirFlag, "err", err)
+                os.Exit(1)
+            }
+        }
+        err := serveWorker(*addressFlag, tempdir, tlsConfig)
+        logger.Error("worker failed", "address", *addressFlag, "err", err)
+        os.Exit(1)
+    }
+    var workers []string
+    if *workersFlag != "" {
+        workers = strings.Split(*workersFlag, ",")
+        // Workers are told where to write by absolute path.
+        if tempdir, err = filepath.Abs(tempdir); err != nil {
+            logger.Error("bad -data", "err", err)
+            os.Exit(2)
+        }
+    }
+    jobID := *jobFlag
+    if jobID == "" {
+        jobID = newJobID()
+    }
+    if len(inputs) == 0 {
+        inputs = InputList{{Location: "austen.db"}}
+    }
+    status := NewJobStatus(jobID, m, r, inputs.String(), *outputFlag)
+    log := logger.With("job", jobID)
+    codec, err := CodecByName(*compressFlag)
     if err != nil {
-        log.Fatalf("mkdir: %v", err)
+        log.Error("bad -compress", "err", err)
+        os.Exit(2)
+    }
+    if *formatFlag != FormatSQLite && *formatFlag != FormatRecords {
+        log.Error("bad -intermediate", "format", *formatFlag)
+        os.Exit(2)
     }
-    defer os.RemoveAll(tempdir)
-    address := "localhost:1337"
+    var client Interface = Client{}
+    if *joinFlag != "" || len(inputs.Tags()) > 0 {
+        join, err := inputs.Join(*joinFlag)
+        if err != nil {
+            log.Error("bad -join", "err", err)
+            os.Exit(2)
+        }
+        client = join
+    }
+    inputStores := make([]Storage, len(inputs))
+    inputNames := make([]string, len(inputs))
+    for i, input := range inputs {
+        if inputStores[i], inputNames[i], err = openLocation(input.Location); err != nil {
+            log.Error("bad -input", "err", err)
+            os.Exit(2)
+        }
+    }
+    outputStore, outputName, err := openLocation(*outputFlag)
+    if err != nil {
+        log.Error("bad -output", "err", err)
+        os.Exit(2)
+    }
+    if *leaseFlag <= 0 {
+        log.Error("bad -lease", "lease", *leaseFlag)
+        os.Exit(2)
+    }
+    err = os.MkdirAll(tempdir, fs.ModePerm)
+    if err != nil {
+        log.Error("mkdir", "dir", tempdir, "err", err)
+        os.Exit(1)
+    }
+    journal, err := OpenJournal(*stateFlag, jobID)
+    if err != nil {
+        log.Error("opening journal", "path", *stateFlag, "err", err)
+        os.Exit(1)
+    }
+    defer journal.Close()
+    address := *addressFlag
+    lease, err := journal.Lease(leaseHolder(), address, *leaseFlag)
+    if err != nil {
+        log.Error("opening lease", "path", *stateFlag, "err", err)
+        os.Exit(1)
+    }
+    if *standbyFlag {
+        log.Info("standing by", "holder", lease.Holder, "path", *stateFlag)
+        if !lease.Follow(journal, log) {
+            if outcome, _ := lease.Outcome(); outcome == JobFailed {
+                os.Exit(1)
+            }
+            return
+        }
+    } else {
+        if err := lease.Reset(); err != nil {
+            log.Warn("resetting lease", "err", err)
+        }
+        held, err := lease.TryAcquire()
+        if err != nil {
+            log.Error("acquiring lease", "path", *stateFlag, "err", err)
+            os.Exit(1)
+        }
+        if !held {
+            holder, leader, _, _, _ := lease.Leader()
+            log.Error("job is led by another coordinator, use -standby to wait for it", "holder", holder, "address", leader)
+            os.Exit(1)
+        }
+    }
+    log.Info("leading job", "holder", lease.Holder, "address", address)
+    stopLease := make(chan struct{})
+    go lease.Hold(log, stopLease, func() {
+        status.Fail("lost the lease to another coordinator")
+        os.Exit(1)
+    })
+    // Tasks fetch the job's files from address, so it has to be ours before
+    // anything is split or scheduled: another process serving it would
+    // answer for files it does not have.
+    listener, err := net.Listen("tcp", address)
+    if err != nil {
+        log.Error("listening", "address", address, "err", err)
+        os.Exit(1)
+    }
+    resuming, err := journal.Started()
+    if err != nil {
+        log.Error("reading journal", "path", *stateFlag, "err", err)
+        os.Exit(1)
+    }
+    store := &LocalStorage{Dir: tempdir, Host: address}
+    if resuming {
+        log.Info("resuming job from journal", "path", *stateFlag)
+    } else {
+        removeJobFiles(store, tempdir, jobID)
+    }
+    server := &http.Server{Addr: address}
+    if *tlsFlag {
+        if server.TLSConfig, err = setupTLS(*tlsDirFlag, address); err != nil {
+            log.Error("setting up TLS", "dir", *tlsDirFlag, "err", err)
+            os.Exit(1)
+        }
+        log.Info("serving over TLS", "ca", filepath.Join(*tlsDirFlag, "ca.pem"))
+    }
+    var data http.Handler = dataHandler(tempdir)
+    if *signFlag {
+        if err := SignJobURLs(jobID); err != nil {
+            log.Error("making URL signing key", "err", err)
+            os.Exit(1)
+        }
+        data = requireSignature(data)
+    }
+    artifacts := NewArtifactServer(data, log)
     go func() {
-        http.Handle("/data/", http.StripPrefix("/data", http.FileServer(http.Dir(tempdir))))
-        if err := http.ListenAndServe(address, nil); err != nil {
-                log.Printf("Error in HTTP server for %s: %v", address, err)
+        http.Handle("/data/", http.StripPrefix("/data", artifacts))
+        http.Handle("/status", status)
+        http.Handle("/status.json", status)
+        http.HandleFunc("/metrics", metricsHandler)
+        var err error
+        if server.TLSConfig != nil {
+            err = server.ServeTLS(listener, "", "")
+        } else {
+            err = server.Serve(listener)
+        }
+        if err != nil {
+                log.Error("HTTP server failed", "address", address, "err", err)
         }
     }()
-    _, _ = splitDatabase("austen.db", tempdir, "map_%d_source.db", m) // SPLIT INTO /TMP/DATA/
-
-    fmt.Printf("\nStarting Map\n")
-    var client = Client{}
-    used_routines := new(int)
-    *used_routines = 0
+    if *progressFlag > 0 {
+        ticker := time.NewTicker(*progressFlag)
+        defer ticker.Stop()
+        go func() {
+            for range ticker.C {
+                fraction, eta := status.Progress()
+                log.Info("progress", "done", percent(fraction), "eta", eta.Round(time.Second))
+            }
+        }()
+    }
+    status.SetPhase("split")
+    // Every input is split m ways, and map task i reads split i of each.
+    var splits []string
     for i := 0; i < m; i++ {
-        task := MapTask{M: m, R: r, N: i, SourceHost: address}
-        if *used_routines < 8 {
-            *used_routines += 1
-            go task.Process(tempdir, client, true, used_routines)
-            fmt.Printf("processing task %d. there are %d more goroutines available\n", i, 8 - *used_routines)
-        } else {
-            fmt.Printf("processing task %d without using a goroutine\n", i)
-            task.Process(tempdir, client, false, used_routines)
+        splits = append(splits, mapSplitFiles(jobID, inputs.Tags(), i)...)
+    }
+    var splitChecksums map[string]string
+    if done, _ := journal.Entries("split"); len(done) > 0 && exists(store, splits) {
+        log.Info("source already split", "source", inputs.String())
+        splitChecksums = done[0].Checksums
+    } else {
+        splitChecksums = make(map[string]string)
+        for i, input := range inputs {
+            log.Info("splitting source", "source", input.Location, "tag", input.Tag, "splits", m, "dir", tempdir)
+            pattern, local := mapSourcePattern(jobID), jobID+"_input.db"
+            if input.Tag != "" {
+                pattern, local = mapTaggedSourcePattern(jobID, input.Tag), jobID+"_input_"+input.Tag+".db"
+            }
+            source, err := fetch(inputStores[i], inputNames[i], filepath.Join(tempdir, local))
+            if err != nil {
+                log.Error("fetching source", "source", input.Location, "err", err)
+                os.Exit(1)
+            }
+            paths, err := splitDatabase(source, tempdir, pattern, m) // SPLIT INTO /TMP/DATA/
+            if err != nil {
+                log.Error("splitting source", "source", input.Location, "err", err)
+                os.Exit(1)
+            }
+            for _, path := range paths {
+                split := filepath.Base(path)
+                if splitChecksums[split], err = fileChecksum(path); err != nil {
+                    log.Error("checksumming split", "split", split, "err", err)
+                    os.Exit(1)
+                }
+                if err := publish(store, path, split); err != nil {
+                    log.Error("publishing split", "split", split, "err", err)
+                    os.Exit(1)
+                }
+            }
+        }
+        if err := journal.Record("split", 0, tempdir, nil, splitChecksums); err != nil {
+            log.Warn("journaling split", "err", err)
         }
-
     }
-    for *used_routines > 0 {
-        continue
+    for i := 0; i < m; i++ {
+        for _, split := range mapSplitFiles(jobID, inputs.Tags(), i) {
+            artifacts.Register(Artifact{Job: jobID, Phase: "split", Task: i, Partition: -1, Name: split})
+        }
     }
-    fmt.Printf("\nFinished mapping\n")
-    fmt.Printf("\nStarting Reduce\n")
-    hosts := make([]string, 1)
-    hosts[0] = address
-
-    remainder := m % r
-    offset := 0
-    var first, last float64
-    urls := make([]string, r)
-    for j := 0; j < r; j++ {
-        task := ReduceTask{M: m, R: r, N: j, SourceHosts: hosts}
-        first = float64(j * (m / r) + offset)
-        last = first + (math.Floor(float64(m / r))-1)
-        if remainder > 0 {
-            last++
-            remainder--
-            offset++
+    var cacheFiles []string
+    var cacheChecksums map[string]string
+    if *cacheFlag != "" {
+        cacheFiles, cacheChecksums, err = publishCacheFiles(jobID, strings.Split(*cacheFlag, ","), store)
+        if err != nil {
+            log.Error("publishing cache files", "err", err)
+            os.Exit(1)
+        }
+        status.CacheFiles = cacheFiles
+        for _, name := range cacheFiles {
+            artifacts.Register(Artifact{Job: jobID, Phase: "cache", Task: -1, Partition: -1, Name: cacheFile(jobID, name)})
         }
+    }
 
-        if *used_routines < 8 {
-            *used_routines += 1
-            go task.Process(tempdir, client, true, used_routines, first, last)
-            fmt.Printf("processing task %d. there are %d more goroutines available\n", j, 8 - *used_routines)
-        } else {
-            fmt.Printf("processing task %d without using a goroutine\n", j)
-            task.Process(tempdir, client, false, used_routines, first, last)
+    job := &Job{
+        ID: jobID, M: m, R: r, Address: address, TempDir: tempdir, Store: store,
+        InputTags: inputs.Tags(), InputMappers: inputs.Mappers(), CacheFiles: cacheFiles, Client: client, Status: status, Log: log,
+        Committer: &OutputCommitter{Dir: tempdir, JobID: jobID, Store: store}, Journal: journal, Artifacts: artifacts,
+        SkipBadRecords: *skipFlag, SkipAfter: *skipAfterFlag, MaxSkippedRecords: *maxSkippedFlag,
+        ReduceParallel: *parallelFlag, OrderedOutput: *orderedFlag,
+        Codec: codec, Format: *formatFlag, MaxFetchFailures: *fetchFailuresFlag, DirectReads: *directFlag,
+    }
+    job.addChecksums(splitChecksums)
+    job.addChecksums(cacheChecksums)
+    if err := job.Committer.SetupJob(); err != nil {
+        log.Error("setting up output committer", "err", err)
+        os.Exit(1)
+    }
+    scheduler := NewScheduler(8, log)
+    scheduler.Workers = append([]string{address}, workers...)
+    scheduler.Speculative = *speculateFlag
+    scheduler.MaxAttempts = *attemptsFlag
+    scheduler.Backoff = *backoffFlag
+    scheduler.MaxWorkerFailures = *blacklistFlag
+    scheduler.Status = status
+    metricTotalSlots.Set(float64(scheduler.Slots * len(scheduler.Workers)))
+    fail := func(msg string, err error) {
+        log.Error(msg, "err", err)
+        status.Fail(fmt.Sprintf("%s: %v", msg, err))
+        // The job has failed for good: tell standbys not to take it over.
+        close(stopLease)
+        if err := lease.Release(JobFailed); err != nil {
+            log.Warn("releasing lease", "err", err)
         }
-        urls[j] = makeURL(hosts[0], reduceOutputFile(task.N))
+        if err := journal.Forget(); err != nil {
+            log.Warn("clearing journal", "err", err)
+        }
+        artifacts.Purge(jobID)
+        removeJobFiles(store, tempdir, jobID)
+        if err := WriteReport(status.Report(), *historyFlag); err != nil {
+            log.Error("writing job report", "err", err)
+        }
+        os.Exit(1)
+    }
+
+    log.Info("starting map", "tasks", m)
+    status.SetPhase("map")
+    maps := job.mapPhase()
+    maps.MaxFailedPercent = *mapFailuresFlag
+    if err := scheduler.RunPhase(maps); err != nil {
+        fail("map failed", err)
+    }
+    job.FailedMaps = maps.Failed
+    if len(maps.Failed) > 0 {
+        log.Warn("finished map without some tasks", "failed", len(maps.Failed), "tolerated", percent(*mapFailuresFlag/100))
+    } else {
+        log.Info("finished map")
     }
 
-    for *used_routines > 0 {
-        continue
+    log.Info("starting reduce", "tasks", r)
+    status.SetPhase("reduce")
+    if err := scheduler.RunPhase(job.reducePhase()); err != nil {
+        fail("reduce failed", err)
+    }
+    log.Info("finished reduce")
+    outputs := make([]string, r)
+    for j := range outputs {
+        outputs[j] = reduceOutputFile(jobID, j)
+    }
+    status.SetPhase("merge")
+    paths, err := fetchAll(store, outputs, tempdir, job.checksumsOf(outputs))
+    if err != nil {
+        fail("fetching reduce output", err)
+    }
+    result := filepath.Join(tempdir, jobID+"_result.db")
+    final_output_db, err := mergeDatabases(paths, result)
+    if final_output_db != nil {
+        final_output_db.Close()
+    }
+    if err != nil {
+        fail("merging reduce output", err)
+    }
+    if err := publish(outputStore, result, outputName); err != nil {
+        fail("writing output", err)
+    }
+
+    counters := status.Counters()
+    var fields []interface{}
+    values := counters.Snapshot()
+    for _, name := range counters.Names() {
+        fields = append(fields, name, values[name])
+    }
+    log.Info("job counters", fields...)
+    saved := filepath.Join(tempdir, jobID+"_counters.db")
+    err = counters.Save(saved)
+    if err == nil {
+        err = publish(outputStore, saved, countersFile(outputName))
+    }
+    if err != nil {
+        log.Error("saving counters", "err", err)
+    }
+    quarantined := filepath.Join(tempdir, jobID+"_quarantined.db")
+    if skipped, err := collectQuarantine(tempdir, jobID, quarantined); err != nil {
+        log.Error("collecting skipped records", "err", err)
+    } else if skipped > 0 {
+        if err := publish(outputStore, quarantined, quarantineOutput(outputName)); err != nil {
+            log.Error("saving skipped records", "err", err)
+        }
+        log.Warn("skipped bad records", "records", skipped, "quarantine", outputStore.URL(quarantineOutput(outputName)))
+    }
+    status.SetPhase("done")
+    close(stopLease)
+    if err := lease.Release(JobSucceeded); err != nil {
+        log.Warn("releasing lease", "err", err)
+    }
+    if err := journal.Forget(); err != nil {
+        log.Warn("clearing journal", "err", err)
+    }
+    artifacts.Purge(jobID)
+    removeJobFiles(store, tempdir, jobID)
+    if err := WriteReport(status.Report(), *historyFlag); err != nil {
+        log.Error("writing job report", "err", err)
     }
-    fmt.Printf("\nFinished reducing\n")
-    final_output_db, err := mergeDatabases(urls, "result.db", tempdir)
-    final_output_db.Close()
 }
 
 